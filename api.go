@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// listen opens a listener for a tcp or unix connection string,
+// e.g. tcp://127.0.0.1:8484 or unix:///var/run/plumber.sock
+func listen(addr string) (net.Listener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		// Remove a stale socket left behind by a previous run
+		if err := os.Remove(u.Path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", u.Path)
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+	}
+	return nil, fmt.Errorf("Unsupported listen address '%s'", addr)
+}
+
+func newAPIRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/containers", listContainers).Methods("GET")
+	r.HandleFunc("/containers/{ref}", getContainer).Methods("GET")
+	r.HandleFunc("/containers/{ref}/netem", setNetem).Methods("PUT", "DELETE")
+	r.HandleFunc("/parents", listParents).Methods("GET")
+	r.HandleFunc("/parents/{name}", getParent).Methods("GET")
+	r.HandleFunc("/leases", listLeases).Methods("GET")
+	r.HandleFunc("/attachments", listAttachments).Methods("GET")
+	r.HandleFunc("/config/reload", reloadConfig).Methods("POST")
+	r.HandleFunc("/metrics", serveMetrics).Methods("GET")
+	return r
+}
+
+func serveAPI(addr string) {
+	l, err := listen(addr)
+	if err != nil {
+		Logger.Fatalf("Failed starting API listener: %s", err.Error())
+	}
+	Logger.Printf("API listening on: %s", addr)
+	go func() {
+		if err := http.Serve(l, newAPIRouter()); err != nil {
+			Logger.Errorf("API listener stopped: %s", err.Error())
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func listContainers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, State.Containers())
+}
+
+// lookupContainer finds the container the request refers to, or writes why not
+func lookupContainer(w http.ResponseWriter, r *http.Request) (ContainerState, bool) {
+	cs, err := State.Lookup(mux.Vars(r)["ref"])
+	if _, ok := err.(*ambiguousRefError); ok {
+		writeError(w, http.StatusBadRequest, err)
+		return cs, false
+	} else if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return cs, false
+	}
+	return cs, true
+}
+
+func getContainer(w http.ResponseWriter, r *http.Request) {
+	cs, ok := lookupContainer(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, cs)
+}
+
+// setNetem replaces the network impairment of a container with the one in the
+// request body; DELETE removes it
+func setNetem(w http.ResponseWriter, r *http.Request) {
+	cs, ok := lookupContainer(w, r)
+	if !ok {
+		return
+	}
+	var netem *Netem
+	if r.Method == "PUT" {
+		netem = &Netem{}
+		if err := json.NewDecoder(r.Body).Decode(netem); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid netem: %s", err.Error()))
+			return
+		}
+		if netem.empty() {
+			netem = nil
+		}
+	}
+	if err := NewContainer(cs.ID).updateNetem(cs, netem); err != nil {
+		status := http.StatusInternalServerError
+		if errorClass(err) == "config" {
+			status = http.StatusBadRequest
+		} else if cs.Status != StatusOnline {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	cs, _ = State.Container(cs.ID)
+	writeJSON(w, http.StatusOK, cs)
+}
+
+// reloadConfig reloads the configuration file; '?reconcile=true' sets up the
+// containers whose profile changed again
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if ConfigReloader == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("Plumber was started without a configuration file"))
+		return
+	}
+	reconcile := ConfigReloader.reconcile
+	if v := r.URL.Query().Get("reconcile"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid reconcile '%s'", v))
+			return
+		}
+		reconcile = b
+	}
+	result, err := ConfigReloader.Reload(reconcile)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func listParents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, State.Parents())
+}
+
+func getParent(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, p := range State.Parents() {
+		if p.Name == name {
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("No such parent link: %s", name))
+}
+
+func listAttachments(w http.ResponseWriter, r *http.Request) {
+	if Attachments == nil {
+		writeJSON(w, http.StatusOK, []Attachment{})
+		return
+	}
+	attachments, err := Attachments.List(r.URL.Query().Get("container"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, attachments)
+}
+
+func listLeases(w http.ResponseWriter, r *http.Request) {
+	am := currentIPAM()
+	if am == nil {
+		writeJSON(w, http.StatusOK, []Lease{})
+		return
+	}
+	leases, err := am.Leases()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
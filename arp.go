@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	ethPArp      = 0x0806
+	arpRequest   = 1
+	arpReply     = 2
+	arpFrameSize = 42
+)
+
+var ethBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// arpConn is a raw ARP socket bound to one interface. It belongs to the
+// network namespace of the thread that opened it.
+type arpConn struct {
+	fd  int
+	ifc *net.Interface
+}
+
+type arpPacket struct {
+	op        uint16
+	senderMAC net.HardwareAddr
+	senderIP  net.IP
+	targetMAC net.HardwareAddr
+	targetIP  net.IP
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openARP(ifc *net.Interface) (*arpConn, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening ARP socket: %s", err.Error())
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: ifc.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Error binding ARP socket to '%s': %s", ifc.Name, err.Error())
+	}
+	return &arpConn{fd: fd, ifc: ifc}, nil
+}
+
+func (a *arpConn) Close() error {
+	return syscall.Close(a.fd)
+}
+
+// arpFrame builds a broadcast ethernet frame holding an ARP packet
+func arpFrame(op uint16, senderMAC net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	b := make([]byte, arpFrameSize)
+	copy(b[0:6], ethBroadcast)
+	copy(b[6:12], senderMAC)
+	binary.BigEndian.PutUint16(b[12:14], ethPArp)
+	binary.BigEndian.PutUint16(b[14:16], 1)      // Ethernet
+	binary.BigEndian.PutUint16(b[16:18], 0x0800) // IPv4
+	b[18], b[19] = 6, 4
+	binary.BigEndian.PutUint16(b[20:22], op)
+	copy(b[22:28], senderMAC)
+	copy(b[28:32], senderIP.To4())
+	copy(b[32:38], targetMAC)
+	copy(b[38:42], targetIP.To4())
+	return b
+}
+
+// parseARP returns the ARP packet in an ethernet frame, or nil when the frame
+// holds none
+func parseARP(b []byte) *arpPacket {
+	if len(b) < arpFrameSize || binary.BigEndian.Uint16(b[12:14]) != ethPArp {
+		return nil
+	}
+	return &arpPacket{
+		op:        binary.BigEndian.Uint16(b[20:22]),
+		senderMAC: net.HardwareAddr(append([]byte{}, b[22:28]...)),
+		senderIP:  net.IP(append([]byte{}, b[28:32]...)),
+		targetMAC: net.HardwareAddr(append([]byte{}, b[32:38]...)),
+		targetIP:  net.IP(append([]byte{}, b[38:42]...)),
+	}
+}
+
+// send writes an ARP packet to the broadcast address
+func (a *arpConn) send(op uint16, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) error {
+	return a.write(arpFrame(op, a.ifc.HardwareAddr, senderIP, targetMAC, targetIP))
+}
+
+// write sends a complete ethernet frame on the interface
+func (a *arpConn) write(frame []byte) error {
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(binary.BigEndian.Uint16(frame[12:14])),
+		Ifindex:  a.ifc.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], frame[0:6])
+	return syscall.Sendto(a.fd, frame, 0, addr)
+}
+
+// receive reads the next ARP packet, waiting at most until deadline
+func (a *arpConn) receive(deadline time.Time) (*arpPacket, error) {
+	b := make([]byte, 1500)
+	for {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, nil
+		}
+		tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(a.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+		n, _, err := syscall.Recvfrom(a.fd, b, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p := parseARP(b[:n]); p != nil {
+			return p, nil
+		}
+	}
+}
+
+// conflicts reports whether p shows another host using or probing for ip (RFC 5227 section 2.1.1)
+func (p *arpPacket) conflicts(ip net.IP, own net.HardwareAddr) bool {
+	if bytes.Equal(p.senderMAC, own) {
+		return false
+	}
+	if p.senderIP.Equal(ip) {
+		return true
+	}
+	return p.op == arpRequest && p.senderIP.Equal(net.IPv4zero) && p.targetIP.Equal(ip)
+}
+
+// probeAddress performs IPv4 duplicate address detection on ifc by sending
+// count ARP probes interval apart and listening for another host claiming ip.
+// It returns the hardware address of the conflicting host, or nil.
+func probeAddress(ifc *net.Interface, ip net.IP, count int, interval time.Duration) (net.HardwareAddr, error) {
+	a, err := openARP(ifc)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	for i := 0; i < count; i++ {
+		// A probe has an all zero sender address so it does not pollute ARP caches
+		if err := a.send(arpRequest, net.IPv4zero, make(net.HardwareAddr, 6), ip); err != nil {
+			return nil, fmt.Errorf("Error sending ARP probe: %s", err.Error())
+		}
+		wait := interval
+		if i == count-1 {
+			// ANNOUNCE_WAIT is twice the probe interval
+			wait = 2 * interval
+		}
+		deadline := time.Now().Add(wait)
+		for {
+			p, err := a.receive(deadline)
+			if err != nil {
+				return nil, fmt.Errorf("Error receiving ARP packets: %s", err.Error())
+			}
+			if p == nil {
+				break
+			}
+			if p.conflicts(ip, ifc.HardwareAddr) {
+				return p.senderMAC, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// announceAddresses sends count gratuitous ARPs for the IPv4 addresses and
+// unsolicited neighbor advertisements for the global IPv6 addresses of ifc,
+// interval apart, so neighbors replace stale cache entries for the new MAC.
+func announceAddresses(ifc *net.Interface, count int, interval time.Duration) error {
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return err
+	}
+	a, err := openARP(ifc)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := ipNet.IP.To4(); ip != nil {
+				if err := a.send(arpRequest, ip, make(net.HardwareAddr, 6), ip); err != nil {
+					return fmt.Errorf("Error sending gratuitous ARP for '%s': %s", ip, err.Error())
+				}
+			} else if ipNet.IP.IsGlobalUnicast() {
+				if err := a.write(neighborAdvertisement(ifc.HardwareAddr, ipNet.IP)); err != nil {
+					return fmt.Errorf("Error sending neighbor advertisement for '%s': %s", ipNet.IP, err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestARPFrame(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip := net.ParseIP("10.0.0.5")
+
+	// A probe has an all zero sender address
+	frame := arpFrame(arpRequest, mac, net.IPv4zero, make(net.HardwareAddr, 6), ip)
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0x08, 0x06,
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 10, 0, 0, 5,
+	}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("Probe frame is\n% x\nwant\n% x", frame, want)
+	}
+
+	p := parseARP(frame)
+	if p == nil {
+		t.Fatal("Parsing the probe frame failed")
+	}
+	wantPacket := &arpPacket{
+		op:        arpRequest,
+		senderMAC: mac,
+		senderIP:  net.IPv4zero.To4(),
+		targetMAC: make(net.HardwareAddr, 6),
+		targetIP:  ip.To4(),
+	}
+	if !reflect.DeepEqual(p, wantPacket) {
+		t.Errorf("parseARP returned %+v, want %+v", p, wantPacket)
+	}
+
+	// Received frames may be padded to the ethernet minimum
+	if p := parseARP(append(frame, make([]byte, 18)...)); p == nil || !p.targetIP.Equal(ip) {
+		t.Errorf("Parsing a padded frame returned %+v", p)
+	}
+	if p := parseARP(frame[:arpFrameSize-1]); p != nil {
+		t.Errorf("Parsing a short frame returned %+v", p)
+	}
+	ipv6 := append([]byte{}, frame...)
+	ipv6[12], ipv6[13] = 0x86, 0xdd
+	if p := parseARP(ipv6); p != nil {
+		t.Errorf("Parsing an IPv6 frame returned %+v", p)
+	}
+}
+
+func TestARPConflicts(t *testing.T) {
+	own, _ := net.ParseMAC("02:42:ac:11:00:02")
+	other, _ := net.ParseMAC("02:42:ac:11:00:03")
+	ip := net.ParseIP("10.0.0.5")
+	for _, tt := range []struct {
+		name     string
+		op       uint16
+		mac      net.HardwareAddr
+		sender   string
+		target   string
+		conflict bool
+	}{
+		{"reply from the owner", arpReply, other, "10.0.0.5", "10.0.0.1", true},
+		{"request from the owner", arpRequest, other, "10.0.0.5", "10.0.0.1", true},
+		{"probe for the address", arpRequest, other, "0.0.0.0", "10.0.0.5", true},
+		{"our own probe", arpRequest, own, "0.0.0.0", "10.0.0.5", false},
+		{"our own announcement", arpRequest, own, "10.0.0.5", "10.0.0.5", false},
+		{"request for the address", arpRequest, other, "10.0.0.1", "10.0.0.5", false},
+		{"reply for the address", arpReply, other, "0.0.0.0", "10.0.0.5", false},
+		{"probe for another address", arpRequest, other, "0.0.0.0", "10.0.0.6", false},
+	} {
+		p := parseARP(arpFrame(tt.op, tt.mac, net.ParseIP(tt.sender), make(net.HardwareAddr, 6), net.ParseIP(tt.target)))
+		if conflict := p.conflicts(ip, own); conflict != tt.conflict {
+			t.Errorf("%s: conflicts = %v, want %v", tt.name, conflict, tt.conflict)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/urfave/cli"
+)
+
+// Attachment is a link added to a container with 'plumber attach', next to the
+// one its labels ask for. The daemon sets it up again whenever the container
+// starts, until it is detached.
+type Attachment struct {
+	// Container is the name, so the attachment survives recreating the container
+	Container  string                 `json:"container"`
+	Network    ContainerNetworkConfig `json:"network"`
+	ParentLink string                 `json:"parentLink,omitempty"`
+	MacAddr    string                 `json:"macAddress,omitempty"`
+	IPAddr     string                 `json:"ipAddress,omitempty"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	UpdatedAt  time.Time              `json:"updatedAt"`
+}
+
+// AttachmentStore persists attachments in the state directory. The attach and
+// detach subcommands and the daemon share the file, so every access locks it.
+type AttachmentStore struct {
+	path string
+}
+
+var Attachments *AttachmentStore
+
+func NewAttachmentStore(stateDir string) *AttachmentStore {
+	return &AttachmentStore{path: filepath.Join(stateDir, "attachments.json")}
+}
+
+// update applies fn to the attachments while holding the lock on the file,
+// and saves them when fn returns true
+func (s *AttachmentStore) update(fn func(attachments []Attachment) ([]Attachment, bool)) error {
+	lock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	var attachments []Attachment
+	if err := readJSONFile(s.path, &attachments); err != nil {
+		return err
+	}
+	attachments, save := fn(attachments)
+	if !save {
+		return nil
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].Container != attachments[j].Container {
+			return attachments[i].Container < attachments[j].Container
+		}
+		return attachments[i].Network.IfName < attachments[j].Network.IfName
+	})
+	return writeJSONFile(s.path, attachments)
+}
+
+// List returns the attachments of a container, or all of them when container is empty
+func (s *AttachmentStore) List(container string) ([]Attachment, error) {
+	container = strings.TrimPrefix(container, "/")
+	list := []Attachment{}
+	err := s.update(func(attachments []Attachment) ([]Attachment, bool) {
+		for _, a := range attachments {
+			if container == "" || a.Container == container {
+				list = append(list, a)
+			}
+		}
+		return attachments, false
+	})
+	return list, err
+}
+
+// Put adds or replaces the attachment with the same container and link name
+func (s *AttachmentStore) Put(a Attachment) error {
+	a.UpdatedAt = time.Now()
+	return s.update(func(attachments []Attachment) ([]Attachment, bool) {
+		for i := range attachments {
+			if attachments[i].Container == a.Container && attachments[i].Network.IfName == a.Network.IfName {
+				attachments[i] = a
+				return attachments, true
+			}
+		}
+		return append(attachments, a), true
+	})
+}
+
+// Remove deletes an attachment and returns it
+func (s *AttachmentStore) Remove(container string, ifName string) (*Attachment, error) {
+	var removed *Attachment
+	err := s.update(func(attachments []Attachment) ([]Attachment, bool) {
+		for i, a := range attachments {
+			if a.Container == container && a.Network.IfName == ifName {
+				removed = &a
+				return append(attachments[:i], attachments[i+1:]...), true
+			}
+		}
+		return attachments, false
+	})
+	return removed, err
+}
+
+// SetStatus changes the status of the online attachments of a container, e.g.
+// to stopped when it dies
+func (s *AttachmentStore) SetStatus(container string, status string) error {
+	container = strings.TrimPrefix(container, "/")
+	return s.update(func(attachments []Attachment) ([]Attachment, bool) {
+		changed := false
+		for i := range attachments {
+			if attachments[i].Container == container && attachments[i].Status == StatusOnline {
+				attachments[i].Status, attachments[i].UpdatedAt = status, time.Now()
+				changed = true
+			}
+		}
+		return attachments, changed
+	})
+}
+
+// setupAttachment sets up an attachment the way handleContainerNetwork sets up
+// the network of the labels, and records the outcome.
+func (c *Container) setupAttachment(containerInfo *docker.Container, a Attachment) (Attachment, error) {
+	cn := a.Network.clone()
+	SetupsAttempted.Inc(cn.NetworkMode)
+	err := c.authorizeNetwork(containerInfo, &cn)
+	if err == nil {
+		var containerLink *MacvlanLink
+		a.ParentLink, containerLink, err = c.setupMacvlanLink(containerInfo.Name, &cn, a.MacAddr)
+		if containerLink != nil {
+			a.MacAddr = containerLink.options.MacAddr
+		}
+	}
+	a.IPAddr = cn.IPAddress
+	e := AuditEntry{
+		Event:   "setup",
+		Mode:    cn.NetworkMode,
+		Parent:  a.ParentLink,
+		VlanID:  cn.VlanID,
+		Link:    cn.ifName(),
+		MacAddr: a.MacAddr,
+		IPAddr:  a.IPAddr,
+		Detail:  "attachment",
+	}
+	if err != nil {
+		SetupsFailed.Inc(cn.NetworkMode, errorClass(err))
+		a.Status, a.Error = StatusFailed, err.Error()
+		e.Outcome, e.Reason = "failed", err.Error()
+	} else {
+		SetupsSucceeded.Inc(cn.NetworkMode)
+		a.Status, a.Error = StatusOnline, ""
+	}
+	c.audit(e)
+	if perr := Attachments.Put(a); perr != nil {
+		c.Logger.Errorf("Failed saving attachment: %s", perr.Error())
+	}
+	return a, err
+}
+
+// handleAttachments sets up the attachments of a container that started
+func (c *Container) handleAttachments(containerInfo *docker.Container) {
+	if Attachments == nil || containerInfo == nil {
+		return
+	}
+	attachments, err := Attachments.List(containerInfo.Name)
+	if err != nil {
+		c.Logger.Errorf("Failed reading attachments: %s", err.Error())
+		return
+	}
+	for _, a := range attachments {
+		if a, err := c.setupAttachment(containerInfo, a); err != nil {
+			c.Logger.Errorf("Failed setting up attachment '%s': %s", a.Network.IfName, err.Error())
+		} else {
+			c.Logger.Printf("Attachment '%s' online: %s", a.Network.IfName, a.MacAddr)
+		}
+	}
+}
+
+// stopAttachments marks the attachments of a container that stopped
+func (c *Container) stopAttachments() {
+	if Attachments == nil || c.Name == "" {
+		return
+	}
+	if err := Attachments.SetStatus(c.Name, StatusStopped); err != nil {
+		c.Logger.Errorf("Failed saving attachments: %s", err.Error())
+	}
+}
+
+func attachCommand() cli.Command {
+	return cli.Command{
+		Name:      "attach",
+		Usage:     "Add a link to a running container and keep it there until it is detached",
+		ArgsUsage: "<container>",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "vlan", Usage: "VLAN ID of the link"},
+			cli.StringFlag{Name: "mode", Value: "macvlan", Usage: "Network mode"},
+			cli.StringFlag{Name: "ifname", Usage: "Name of the link in the container, by default the first free ethN"},
+			cli.StringFlag{Name: "parent", Usage: "Host link to attach to instead of the --host-link one"},
+			cli.StringFlag{Name: "ip", Usage: "Static address in CIDR notation, e.g. 10.0.0.5/24"},
+			cli.StringFlag{Name: "gateway", Usage: "Default gateway for the static address"},
+			cli.StringFlag{Name: "ipam", Usage: "Lease the address from a pool instead, e.g. pool:backoffice"},
+			cli.IntFlag{Name: "mtu", Usage: "MTU of the link"},
+		},
+		Action: runAttach,
+	}
+}
+
+func detachCommand() cli.Command {
+	return cli.Command{
+		Name:      "detach",
+		Usage:     "Remove a link added with attach",
+		ArgsUsage: "<container>",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "ifname", Usage: "Name of the link in the container, required when it has several attachments"},
+		},
+		Action: runDetach,
+	}
+}
+
+// checkAttachIfName refuses the name of the link plumber sets up from the
+// labels of the container, labelled, so attach does not adopt it and detach
+// does not delete it
+func checkAttachIfName(ifName string, labelled *ContainerNetworkConfig) error {
+	if ifName == HostLinkName || (labelled.IfName != "" && ifName == labelled.IfName) {
+		return fmt.Errorf("'%s' is the link plumber sets up from labels", ifName)
+	}
+	return nil
+}
+
+// freeIfName returns the first ethN that is neither in the container, set up
+// from its labels nor attached
+func freeIfName(pid int, labelled *ContainerNetworkConfig, attachments []Attachment) (string, error) {
+	for i := 1; i < 100; i++ {
+		name := fmt.Sprintf("eth%d", i)
+		taken := checkAttachIfName(name, labelled) != nil
+		for _, a := range attachments {
+			taken = taken || a.Network.IfName == name
+		}
+		if taken {
+			continue
+		}
+		exists, err := linkInNetns(pid, name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("No free interface name in the container")
+}
+
+func runAttach(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("Usage: plumber attach <container> --vlan <id> [--ifname <name>] [--ip <address>]", 1)
+	}
+	if err := initializeGlobals(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	d, err := initializeDocker(DockerHost)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed initializing docker client: %s", err.Error()), 1)
+	}
+	info, err := containerInfo(d, ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error inspecting container: %s", err.Error()), 1)
+	}
+	if !info.State.Running {
+		return cli.NewExitError(fmt.Sprintf("Container '%s' is not running", info.Name), 1)
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+
+	cn := ContainerNetworkConfig{
+		NetworkMode: ctx.String("mode"),
+		VlanID:      ctx.String("vlan"),
+		Parent:      ctx.String("parent"),
+		IfName:      ctx.String("ifname"),
+		IPAddress:   ctx.String("ip"),
+		Gateway:     ctx.String("gateway"),
+		IPAM:        ctx.String("ipam"),
+		MTU:         ctx.Int("mtu"),
+	}
+	existing, err := Attachments.List(name)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed reading attachments: %s", err.Error()), 1)
+	}
+	c := NewContainer(info.ID[0:12])
+	c.Name, c.Image, c.Labels = info.Name, info.Config.Image, info.Config.Labels
+	// Only the link name matters, so a label error is reported by the daemon
+	labelled, _ := c.getContainerNetworkConfig(info)
+	if cn.IfName == "" {
+		if cn.IfName, err = freeIfName(info.State.Pid, &labelled, existing); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if err := checkAttachIfName(cn.IfName, &labelled); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	a := Attachment{Container: name, Network: cn}
+	for _, e := range existing {
+		if e.Network.IfName == cn.IfName {
+			// Attaching again keeps the MAC, so the neighbors need not relearn it
+			a.MacAddr = e.MacAddr
+		}
+	}
+
+	a, err = c.setupAttachment(info, a)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed attaching '%s' to '%s': %s", cn.IfName, name, err.Error()), 1)
+	}
+	fmt.Printf("Attached '%s' to '%s' on '%s': %s %s\n", cn.IfName, name, a.ParentLink, a.MacAddr, a.IPAddr)
+	return nil
+}
+
+func runDetach(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("Usage: plumber detach <container> [--ifname <name>]", 1)
+	}
+	if err := initializeGlobals(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	d, err := initializeDocker(DockerHost)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed initializing docker client: %s", err.Error()), 1)
+	}
+	// A removed container can still be detached by name
+	name := strings.TrimPrefix(ctx.Args().First(), "/")
+	info, err := containerInfo(d, name)
+	if err == nil {
+		name = strings.TrimPrefix(info.Name, "/")
+	}
+
+	attachments, err := Attachments.List(name)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed reading attachments: %s", err.Error()), 1)
+	}
+	ifName := ctx.String("ifname")
+	if ifName == "" && len(attachments) == 1 {
+		ifName = attachments[0].Network.IfName
+	}
+	var a *Attachment
+	for i := range attachments {
+		if attachments[i].Network.IfName == ifName {
+			a = &attachments[i]
+		}
+	}
+	if a == nil {
+		if ifName == "" && len(attachments) > 1 {
+			return cli.NewExitError(fmt.Sprintf("Container '%s' has %d attachments, choose one with --ifname", name, len(attachments)), 1)
+		}
+		return cli.NewExitError(fmt.Sprintf("Container '%s' has no attachment '%s'", name, ifName), 1)
+	}
+
+	if info != nil && info.State.Running {
+		c := NewContainer(info.ID[0:12])
+		c.Name, c.Image, c.Labels = info.Name, info.Config.Image, info.Config.Labels
+		if err := c.teardownContainerLink(info.Name, &a.Network); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed removing '%s' from '%s': %s", ifName, name, err.Error()), 1)
+		}
+	}
+	if am := currentIPAM(); am != nil && a.Network.IPAM != "" {
+		if _, err := am.ReleaseOwner(leaseOwner(name, &a.Network)); err != nil {
+			Logger.Errorf("Failed releasing addresses: %s", err.Error())
+		}
+	}
+	if _, err := Attachments.Remove(name, ifName); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed saving attachments: %s", err.Error()), 1)
+	}
+	fmt.Printf("Detached '%s' from '%s'\n", ifName, name)
+	return nil
+}
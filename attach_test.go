@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckAttachIfName(t *testing.T) {
+	defer func(name string) { HostLinkName = name }(HostLinkName)
+	HostLinkName = "eth0"
+	for _, tt := range []struct {
+		ifName   string
+		labelled ContainerNetworkConfig
+		valid    bool
+	}{
+		{"eth1", ContainerNetworkConfig{}, true},
+		{"eth0", ContainerNetworkConfig{}, false},
+		{"eth0", ContainerNetworkConfig{IfName: "backend0"}, false},
+		{"backend0", ContainerNetworkConfig{IfName: "backend0"}, false},
+		{"eth1", ContainerNetworkConfig{IfName: "backend0"}, true},
+	} {
+		if err := checkAttachIfName(tt.ifName, &tt.labelled); (err == nil) != tt.valid {
+			t.Errorf("checkAttachIfName(%s, %+v) returned %v, want valid %v", tt.ifName, tt.labelled, err, tt.valid)
+		}
+	}
+}
+
+func TestAttachmentStoreSetStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plumber-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewAttachmentStore(dir)
+	for _, a := range []Attachment{
+		{Container: "web", Network: ContainerNetworkConfig{IfName: "eth1"}, Status: StatusOnline},
+		{Container: "web", Network: ContainerNetworkConfig{IfName: "eth2"}, Status: StatusFailed},
+		{Container: "db", Network: ContainerNetworkConfig{IfName: "eth1"}, Status: StatusOnline},
+	} {
+		if err := s.Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SetStatus("/web", StatusStopped); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"db/eth1": StatusOnline, "web/eth1": StatusStopped, "web/eth2": StatusFailed}
+	for _, a := range list {
+		key := a.Container + "/" + a.Network.IfName
+		if a.Status != want[key] {
+			t.Errorf("Attachment %s is %s, want %s", key, a.Status, want[key])
+		}
+	}
+	if len(list) != len(want) {
+		t.Errorf("Got %d attachments, want %d", len(list), len(want))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a line of the audit log. Events are 'setup' and 'policy' for
+// the outcome of a container network setup, and 'parent.create', 'link.*',
+// 'address.*', 'route.*', 'firewall.*', 'sysctl.*', 'shaping.*', 'mirror.*'
+// and 'netns.*' for the individual changes. Parent links are shared by the
+// containers on a VLAN and never removed, so there is no 'parent.delete'.
+type AuditEntry struct {
+	Time        time.Time         `json:"time"`
+	Event       string            `json:"event"`
+	ContainerID string            `json:"containerId,omitempty"`
+	Container   string            `json:"container,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Mode        string            `json:"mode,omitempty"`
+	Parent      string            `json:"parent,omitempty"`
+	VlanID      string            `json:"vlanId,omitempty"`
+	Link        string            `json:"link,omitempty"`
+	MacAddr     string            `json:"macAddress,omitempty"`
+	IPAddr      string            `json:"ipAddress,omitempty"`
+	Detail      string            `json:"detail,omitempty"`
+	Outcome     string            `json:"outcome"`
+	Reason      string            `json:"reason,omitempty"`
+}
+
+// AuditLog appends JSON lines to a file, which is rotated to path.1 and so on
+// when it grows beyond maxSize bytes.
+type AuditLog struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	size     int64
+	f        *os.File
+}
+
+var Audit *AuditLog
+
+// LinkChange is a change a reexec command made in a container namespace,
+// reported to the daemon for the audit log.
+type LinkChange struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Link   string    `json:"link,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// linkChanges collects the changes of the reexec command of this process
+var linkChanges []LinkChange
+
+func recordLinkChange(event string, link string, detail string) {
+	linkChanges = append(linkChanges, LinkChange{Time: time.Now(), Event: event, Link: link, Detail: detail})
+}
+
+func openAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, dropping the oldest, and starts a new
+// file. The new file is created first, so the old ones are kept when that fails.
+func (a *AuditLog) rotate() error {
+	next := a.path + ".new"
+	f, err := os.OpenFile(next, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	a.f.Close()
+	a.f, a.size = f, 0
+	for i := a.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxFiles > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return os.Rename(next, a.path)
+}
+
+// networkLabels returns the plumber.network.* labels a container requested
+func networkLabels(labels map[string]string) map[string]string {
+	requested := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, networkLabelPrefix) {
+			requested[k] = v
+		}
+	}
+	return requested
+}
+
+// Write appends e to the log; a nil log discards it
+func (a *AuditLog) Write(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	a.Lock()
+	defer a.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		// Keep writing to the current file rather than losing entries
+		if err := a.rotate(); err != nil {
+			Logger.Errorf("Failed rotating audit log '%s': %s", a.path, err.Error())
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		Logger.Errorf("Failed writing audit log '%s': %s", a.path, err.Error())
+	}
+}
+
+// audit writes e for the container, filling in what is known about it
+func (c *Container) audit(e AuditEntry) {
+	if Audit == nil {
+		return
+	}
+	e.ContainerID = c.ID
+	if e.Container == "" {
+		e.Container = c.Name
+	}
+	if e.Image == "" {
+		e.Image = c.Image
+	}
+	if e.Labels == nil && c.Labels != nil {
+		e.Labels = networkLabels(c.Labels)
+	}
+	if e.Outcome == "" {
+		e.Outcome = "succeeded"
+	}
+	Audit.Write(e)
+}
+
+// auditLinkChanges writes the changes a reexec command reported
+func (c *Container) auditLinkChanges(changes []LinkChange, e AuditEntry) {
+	for _, change := range changes {
+		e.Time, e.Event, e.Link, e.Detail = change.Time, change.Event, change.Link, change.Detail
+		c.audit(e)
+	}
+}
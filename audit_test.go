@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// auditEvents returns the events in an audit log file, nil when it is missing
+func auditEvents(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid line in '%s': %s", path, err)
+		}
+		events = append(events, e.Event)
+	}
+	return events
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	dir, err := ioutil.TempDir("", "plumber-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Every line is over half the maximum size, so each file holds one entry
+	line, _ := json.Marshal(AuditEntry{Event: "link.0", Outcome: "succeeded"})
+	a, err := openAuditLog(path, int64(len(line))*3/2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		a.Write(AuditEntry{Event: fmt.Sprintf("link.%d", i), Outcome: "succeeded"})
+	}
+	for _, tt := range []struct {
+		file   string
+		events []string
+	}{
+		{path, []string{"link.4"}},
+		{path + ".1", []string{"link.3"}},
+		{path + ".2", []string{"link.2"}},
+		{path + ".3", nil},
+	} {
+		if events := auditEvents(t, tt.file); fmt.Sprint(events) != fmt.Sprint(tt.events) {
+			t.Errorf("%s holds %v, want %v", filepath.Base(tt.file), events, tt.events)
+		}
+	}
+
+	// A new file that cannot be created keeps the history and the entries
+	if err := os.Mkdir(path+".new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	a.Write(AuditEntry{Event: "link.5", Outcome: "succeeded"})
+	a.Write(AuditEntry{Event: "link.6", Outcome: "succeeded"})
+	for _, tt := range []struct {
+		file   string
+		events []string
+	}{
+		{path, []string{"link.4", "link.5", "link.6"}},
+		{path + ".1", []string{"link.3"}},
+		{path + ".2", []string{"link.2"}},
+	} {
+		if events := auditEvents(t, tt.file); fmt.Sprint(events) != fmt.Sprint(tt.events) {
+			t.Errorf("After failing rotations %s holds %v, want %v", filepath.Base(tt.file), events, tt.events)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Jump targets that are resolved when a primitive or the program is complete
+const (
+	bpfPass   = -1
+	bpfReject = -2
+)
+
+type bpfInsn struct {
+	code   uint16
+	jt, jf int
+	k      uint32
+}
+
+// bpfProgram is a classic BPF program for ethernet frames built from
+// primitives that each either fall through or reject the frame.
+type bpfProgram struct {
+	insns []bpfInsn
+	start int
+}
+
+func (p *bpfProgram) at(i int) int {
+	return p.start + i
+}
+
+func (p *bpfProgram) load(size uint16, offset uint32) {
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_LD | size | syscall.BPF_ABS, k: offset})
+}
+
+// jeq jumps to jt when the accumulator equals k and to jf otherwise; targets
+// are relative to the start of the primitive unless they are bpfPass or bpfReject
+func (p *bpfProgram) jeq(k uint32, jt, jf int) {
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, jt: p.target(jt), jf: p.target(jf), k: k})
+}
+
+func (p *bpfProgram) target(t int) int {
+	if t < 0 {
+		return t
+	}
+	return p.at(t)
+}
+
+func (p *bpfProgram) ethertype(t uint32) {
+	p.load(syscall.BPF_H, 12)
+	p.jeq(t, bpfPass, bpfReject)
+}
+
+// protocol matches the IPv4 protocol or IPv6 next header
+func (p *bpfProgram) protocol(v4, v6 uint32) {
+	p.load(syscall.BPF_H, 12)
+	p.jeq(0x0800, 2, 4)
+	p.load(syscall.BPF_B, 23)
+	p.jeq(v4, bpfPass, bpfReject)
+	p.jeq(0x86dd, 5, bpfReject)
+	p.load(syscall.BPF_B, 20)
+	p.jeq(v6, bpfPass, bpfReject)
+}
+
+func (p *bpfProgram) host(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		k := binary.BigEndian.Uint32(ip4)
+		p.load(syscall.BPF_H, 12)
+		p.jeq(0x0800, 2, bpfReject)
+		p.load(syscall.BPF_W, 26)
+		p.jeq(k, bpfPass, 4)
+		p.load(syscall.BPF_W, 30)
+		p.jeq(k, bpfPass, bpfReject)
+		return
+	}
+	p.load(syscall.BPF_H, 12)
+	p.jeq(0x86dd, 2, bpfReject)
+	// Compare the source, then the destination address word by word
+	for i, offset := range []uint32{22, 38} {
+		next := 2 + 8*(i+1)
+		if i == 1 {
+			next = bpfReject
+		}
+		for w := 0; w < 4; w++ {
+			k := binary.BigEndian.Uint32(ip[4*w : 4*w+4])
+			p.load(syscall.BPF_W, offset+uint32(4*w))
+			match := 2 + 8*i + 2*w + 2
+			if w == 3 {
+				match = bpfPass
+			}
+			p.jeq(k, match, next)
+		}
+	}
+}
+
+// port matches TCP and UDP source or destination ports over IPv4 and IPv6
+func (p *bpfProgram) port(port uint32) {
+	p.load(syscall.BPF_H, 12)
+	p.jeq(0x0800, 2, 12)
+	p.load(syscall.BPF_B, 23)
+	p.jeq(6, 5, 4)
+	p.jeq(17, 5, bpfReject)
+	// Only the first fragment has the ports
+	p.load(syscall.BPF_H, 20)
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, jt: bpfReject, jf: p.at(7), k: 0x1fff})
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH, k: 14})
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND, k: 14})
+	p.jeq(port, bpfPass, 10)
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND, k: 16})
+	p.jeq(port, bpfPass, bpfReject)
+	p.jeq(0x86dd, 13, bpfReject)
+	p.load(syscall.BPF_B, 20)
+	p.jeq(6, 16, 15)
+	p.jeq(17, 16, bpfReject)
+	p.load(syscall.BPF_H, 54)
+	p.jeq(port, bpfPass, 18)
+	p.load(syscall.BPF_H, 56)
+	p.jeq(port, bpfPass, bpfReject)
+}
+
+// compileFilter compiles a capture filter of primitives joined by 'and':
+// arp, ip, ip6, tcp, udp, icmp, host <address> and port <number>.
+// An empty filter returns no program.
+func compileFilter(filter string, snaplen uint32) ([]syscall.SockFilter, error) {
+	fields := strings.Fields(filter)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	p := &bpfProgram{}
+	expectPrimitive := true
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if !expectPrimitive {
+			if f != "and" && f != "&&" {
+				return nil, fmt.Errorf("Expected 'and' instead of '%s' in filter", f)
+			}
+			expectPrimitive = true
+			continue
+		}
+		p.start = len(p.insns)
+		switch f {
+		case "arp":
+			p.ethertype(0x0806)
+		case "ip":
+			p.ethertype(0x0800)
+		case "ip6":
+			p.ethertype(0x86dd)
+		case "tcp":
+			p.protocol(6, 6)
+		case "udp":
+			p.protocol(17, 17)
+		case "icmp":
+			p.protocol(1, 58)
+		case "host", "port":
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("Missing value for '%s' in filter", f)
+			}
+			i++
+			if f == "host" {
+				ip := net.ParseIP(fields[i])
+				if ip == nil {
+					return nil, fmt.Errorf("Invalid host '%s' in filter", fields[i])
+				}
+				p.host(ip)
+			} else {
+				n, err := strconv.ParseUint(fields[i], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid port '%s' in filter", fields[i])
+				}
+				p.port(uint32(n))
+			}
+		default:
+			return nil, fmt.Errorf("Unknown filter primitive '%s'", f)
+		}
+		// Passing a primitive continues with the next one
+		for j := p.start; j < len(p.insns); j++ {
+			if p.insns[j].jt == bpfPass {
+				p.insns[j].jt = len(p.insns)
+			}
+			if p.insns[j].jf == bpfPass {
+				p.insns[j].jf = len(p.insns)
+			}
+		}
+		expectPrimitive = false
+	}
+	if expectPrimitive {
+		return nil, fmt.Errorf("Filter '%s' ends with 'and'", filter)
+	}
+
+	accept := len(p.insns)
+	reject := accept + 1
+	prog := make([]syscall.SockFilter, 0, len(p.insns)+2)
+	for i, insn := range p.insns {
+		f := syscall.SockFilter{Code: insn.code, K: insn.k}
+		if insn.code&0x07 == syscall.BPF_JMP {
+			jt, jf := insn.jt, insn.jf
+			if jt == bpfReject {
+				jt = reject
+			}
+			if jf == bpfReject {
+				jf = reject
+			}
+			if jt-i-1 > 255 || jf-i-1 > 255 {
+				return nil, fmt.Errorf("Filter '%s' is too long", filter)
+			}
+			f.Jt, f.Jf = uint8(jt-i-1), uint8(jf-i-1)
+		}
+		prog = append(prog, f)
+	}
+	prog = append(prog,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: snaplen},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: 0})
+	return prog, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// runFilter interprets the instructions compileFilter emits and returns the
+// number of bytes the program accepts of frame
+func runFilter(t *testing.T, prog []syscall.SockFilter, frame []byte) uint32 {
+	var a, x uint32
+	for pc := 0; pc < len(prog); pc++ {
+		f := prog[pc]
+		load := func(offset uint32, size uint16) uint32 {
+			switch size {
+			case syscall.BPF_B:
+				return uint32(frame[offset])
+			case syscall.BPF_H:
+				return uint32(binary.BigEndian.Uint16(frame[offset:]))
+			}
+			return binary.BigEndian.Uint32(frame[offset:])
+		}
+		switch f.Code & 0x07 {
+		case syscall.BPF_RET:
+			return f.K
+		case syscall.BPF_LDX:
+			x = uint32(frame[f.K]&0x0f) * 4
+		case syscall.BPF_LD:
+			if f.Code&0xe0 == syscall.BPF_IND {
+				a = load(x+f.K, f.Code&0x18)
+			} else {
+				a = load(f.K, f.Code&0x18)
+			}
+		case syscall.BPF_JMP:
+			match := a == f.K
+			if f.Code&0xf0 == syscall.BPF_JSET {
+				match = a&f.K != 0
+			}
+			if match {
+				pc += int(f.Jt)
+			} else {
+				pc += int(f.Jf)
+			}
+		default:
+			t.Fatalf("Unexpected instruction %#v", f)
+		}
+	}
+	t.Fatal("Program ended without returning")
+	return 0
+}
+
+// testFrame builds an ethernet frame carrying a TCP or UDP header, or an ARP
+// request when proto is 0
+func testFrame(src, dst string, proto byte, sport, dport uint16) []byte {
+	frame := make([]byte, 14, 80)
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	var l4 []byte
+	if proto != 0 {
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[0:], sport)
+		binary.BigEndian.PutUint16(l4[2:], dport)
+	}
+	switch {
+	case proto == 0:
+		binary.BigEndian.PutUint16(frame[12:], 0x0806)
+		frame = append(frame, make([]byte, 28)...)
+	case s.To4() != nil:
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip := make([]byte, 20)
+		ip[0], ip[9] = 0x45, proto
+		copy(ip[12:], s.To4())
+		copy(ip[16:], d.To4())
+		frame = append(append(frame, ip...), l4...)
+	default:
+		binary.BigEndian.PutUint16(frame[12:], 0x86dd)
+		ip := make([]byte, 40)
+		ip[0], ip[6] = 0x60, proto
+		copy(ip[8:], s.To16())
+		copy(ip[24:], d.To16())
+		frame = append(append(frame, ip...), l4...)
+	}
+	return frame
+}
+
+func TestCompileFilter(t *testing.T) {
+	var (
+		arp     = testFrame("10.0.0.1", "10.0.0.2", 0, 0, 0)
+		tcp4    = testFrame("10.0.0.1", "10.0.0.2", 6, 40000, 80)
+		udp4    = testFrame("10.0.0.3", "10.0.0.1", 17, 53, 40000)
+		tcp6    = testFrame("fd00::1", "fd00::2", 6, 40000, 443)
+		udp6    = testFrame("fd00::2", "fd00::3", 17, 40000, 53)
+		icmp4   = testFrame("10.0.0.2", "10.0.0.4", 1, 0, 0)
+		frames  = map[string][]byte{"arp": arp, "tcp4": tcp4, "udp4": udp4, "tcp6": tcp6, "udp6": udp6, "icmp4": icmp4}
+		ordered = []string{"arp", "tcp4", "udp4", "tcp6", "udp6", "icmp4"}
+	)
+	for _, tt := range []struct {
+		filter string
+		accept []string
+	}{
+		{"arp", []string{"arp"}},
+		{"ip", []string{"tcp4", "udp4", "icmp4"}},
+		{"ip6", []string{"tcp6", "udp6"}},
+		{"tcp", []string{"tcp4", "tcp6"}},
+		{"udp", []string{"udp4", "udp6"}},
+		{"icmp", []string{"icmp4"}},
+		{"host 10.0.0.1", []string{"tcp4", "udp4"}},
+		{"host fd00::2", []string{"tcp6", "udp6"}},
+		{"port 53", []string{"udp4", "udp6"}},
+		{"port 40000", []string{"tcp4", "udp4", "tcp6", "udp6"}},
+		{"ip and port 40000", []string{"tcp4", "udp4"}},
+		{"udp && host 10.0.0.3 and port 53", []string{"udp4"}},
+		{"tcp and port 53", nil},
+	} {
+		prog, err := compileFilter(tt.filter, 96)
+		if err != nil {
+			t.Errorf("compileFilter(%q) failed: %s", tt.filter, err)
+			continue
+		}
+		accept := make(map[string]bool)
+		for _, name := range tt.accept {
+			accept[name] = true
+		}
+		for _, name := range ordered {
+			want := uint32(0)
+			if accept[name] {
+				want = 96
+			}
+			if got := runFilter(t, prog, frames[name]); got != want {
+				t.Errorf("Filter %q returned %d for %s, want %d", tt.filter, got, name, want)
+			}
+		}
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"tcp or udp",
+		"tcp and",
+		"host",
+		"host example.com",
+		"port 65536",
+		"port http",
+		"vlan 100",
+	} {
+		if _, err := compileFilter(filter, 65535); err == nil {
+			t.Errorf("compileFilter(%q) succeeded, want an error", filter)
+		}
+	}
+	if prog, err := compileFilter("  ", 65535); prog != nil || err != nil {
+		t.Errorf("compileFilter of an empty filter returned %v, %v", prog, err)
+	}
+}
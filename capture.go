@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	ethPAll       = 0x0003
+	pcapLinkEther = 1
+)
+
+func captureCommand() cli.Command {
+	return cli.Command{
+		Name:      "capture",
+		Usage:     "Capture packets on the network interface of a container into a pcap file",
+		ArgsUsage: "<container>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "iface",
+				Usage: "The interface in the container, defaults to the host link name",
+			},
+			cli.IntFlag{
+				Name:  "count",
+				Usage: "Stop after capturing this many packets, 0 captures until interrupted",
+			},
+			cli.StringFlag{
+				Name:  "w",
+				Usage: "The pcap file to write, - for stdout",
+			},
+			cli.StringFlag{
+				Name:  "filter",
+				Usage: "Only capture packets matching primitives joined by 'and': arp, ip, ip6, tcp, udp, icmp, host <address>, port <number>",
+			},
+			cli.IntFlag{
+				Name:  "snaplen",
+				Value: 65535,
+				Usage: "Bytes captured of each packet",
+			},
+		},
+		Action: runCapture,
+	}
+}
+
+// maxSnaplen is the largest snapshot length libpcap accepts
+const maxSnaplen = 262144
+
+// pcapWriter writes packets in the classic libpcap file format
+type pcapWriter struct {
+	w *bufio.Writer
+}
+
+func newPcapWriter(w io.Writer, snaplen uint32) (*pcapWriter, error) {
+	p := &pcapWriter{w: bufio.NewWriter(w)}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], snaplen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkEther)
+	_, err := p.w.Write(hdr)
+	return p, err
+}
+
+func (p *pcapWriter) writePacket(ts time.Time, data []byte, length int) error {
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(length))
+	if _, err := p.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *pcapWriter) Flush() error {
+	return p.w.Flush()
+}
+
+// openCaptureSocket opens a packet socket on the named interface in ns. The
+// filter is attached before the socket is bound so no other packets are queued.
+func openCaptureSocket(ns netns.NsHandle, iface string, filter []syscall.SockFilter) (int, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return -1, fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	if err := netns.Set(ns); err != nil {
+		return -1, fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	defer netns.Set(origns)
+
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return -1, fmt.Errorf("Error finding interface '%s' in container: %s", iface, err.Error())
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return -1, fmt.Errorf("Error opening packet socket: %s", err.Error())
+	}
+	if filter != nil {
+		if err := syscall.AttachLsf(fd, filter); err != nil {
+			syscall.Close(fd)
+			return -1, fmt.Errorf("Error attaching capture filter: %s", err.Error())
+		}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: ifc.Index}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("Error binding packet socket to '%s': %s", iface, err.Error())
+	}
+	return fd, nil
+}
+
+func runCapture(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("Usage: plumber capture <container> -w <file>", 1)
+	}
+	out := ctx.String("w")
+	if out == "" {
+		return cli.NewExitError("A pcap file is required, use -w", 1)
+	}
+	iface := ctx.String("iface")
+	if iface == "" {
+		iface = ctx.GlobalString("host-link")
+	}
+	if n := ctx.Int("snaplen"); n < 1 || n > maxSnaplen {
+		return cli.NewExitError(fmt.Sprintf("Invalid snaplen %d, must be between 1 and %d", n, maxSnaplen), 1)
+	}
+	snaplen := uint32(ctx.Int("snaplen"))
+	filter, err := compileFilter(ctx.String("filter"), snaplen)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ns, _, err := containerNetns(ctx.Args().First(), ctx.GlobalString("docker-host"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer ns.Close()
+	fd, err := openCaptureSocket(ns, iface, filter)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer syscall.Close(fd)
+
+	w := os.Stdout
+	if out != "-" {
+		if w, err = os.Create(out); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer w.Close()
+	}
+	pcap, err := newPcapWriter(w, snaplen)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer pcap.Flush()
+
+	// Reads time out regularly so an interrupt stops the capture
+	var stop int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		atomic.StoreInt32(&stop, 1)
+	}()
+	tv := syscall.NsecToTimeval(int64(500 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Capturing on '%s' of '%s'\n", iface, ctx.Args().First())
+	b := make([]byte, snaplen)
+	count := 0
+	for atomic.LoadInt32(&stop) == 0 && (ctx.Int("count") == 0 || count < ctx.Int("count")) {
+		// MSG_TRUNC returns the length of the packet on the wire
+		n, _, err := syscall.Recvfrom(fd, b, syscall.MSG_TRUNC)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error reading packets: %s", err.Error()), 1)
+		}
+		captured := n
+		if captured > len(b) {
+			captured = len(b)
+		}
+		if err := pcap.writePacket(time.Now(), b[:captured], n); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error writing packets: %s", err.Error()), 1)
+		}
+		count++
+	}
+	fmt.Fprintf(os.Stderr, "%d packets captured\n", count)
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libcontainer/netlink"
+	"github.com/milosgajdos83/tenus"
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netns"
+)
+
+var cniSupportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// CNI error codes, see the CNI specification
+const (
+	cniErrIncompatibleVersion = 1
+	cniErrInvalidEnvironment  = 4
+	cniErrDecoding            = 6
+	cniErrInvalidConfig       = 7
+	cniErrPlugin              = 100
+)
+
+// CNIConfig is the network configuration passed on stdin.
+type CNIConfig struct {
+	CNIVersion string          `json:"cniVersion"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Master     string          `json:"master"`
+	VlanID     interface{}     `json:"vlanid"`
+	Mode       string          `json:"mode"`
+	MTU        int             `json:"mtu"`
+	EgressQoS  string          `json:"egressQosMap"`
+	IngressQoS string          `json:"ingressQosMap"`
+	IPAM       json.RawMessage `json:"ipam"`
+	PrevResult *CNIResult      `json:"prevResult"`
+}
+
+type CNIInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type CNIIPConfig struct {
+	Version   string `json:"version,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+type CNIRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type CNIResult struct {
+	CNIVersion string          `json:"cniVersion"`
+	Interfaces []CNIInterface  `json:"interfaces,omitempty"`
+	IPs        []CNIIPConfig   `json:"ips,omitempty"`
+	Routes     []CNIRoute      `json:"routes,omitempty"`
+	DNS        json.RawMessage `json:"dns,omitempty"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	return e.Msg
+}
+
+type cniArgs struct {
+	command     string
+	containerID string
+	netns       string
+	ifName      string
+	path        string
+	stdin       []byte
+}
+
+func cniCommand() cli.Command {
+	return cli.Command{
+		Name:   "cni",
+		Usage:  "Run as a CNI plugin, reading CNI_* environment variables and the network configuration on stdin",
+		Action: runCNI,
+	}
+}
+
+func runCNI(ctx *cli.Context) error {
+	HostLinkName = ctx.GlobalString("host-link")
+
+	args := cniArgs{
+		command:     os.Getenv("CNI_COMMAND"),
+		containerID: os.Getenv("CNI_CONTAINERID"),
+		netns:       os.Getenv("CNI_NETNS"),
+		ifName:      os.Getenv("CNI_IFNAME"),
+		path:        os.Getenv("CNI_PATH"),
+	}
+	var conf CNIConfig
+	var result interface{}
+	err := func() error {
+		if args.command == "VERSION" {
+			result = map[string]interface{}{"cniVersion": "1.0.0", "supportedVersions": cniSupportedVersions}
+			return nil
+		}
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return &cniError{Code: cniErrDecoding, Msg: "Failed reading network configuration", Details: err.Error()}
+		}
+		args.stdin = stdin
+		if err := json.Unmarshal(stdin, &conf); err != nil {
+			return &cniError{Code: cniErrDecoding, Msg: "Failed decoding network configuration", Details: err.Error()}
+		}
+		if !cniVersionSupported(conf.CNIVersion) {
+			return &cniError{Code: cniErrIncompatibleVersion, Msg: fmt.Sprintf("Unsupported CNI version '%s'", conf.CNIVersion)}
+		}
+		if args.containerID == "" || args.ifName == "" {
+			return &cniError{Code: cniErrInvalidEnvironment, Msg: "CNI_CONTAINERID and CNI_IFNAME are required"}
+		}
+		switch args.command {
+		case "ADD":
+			result, err = cniAdd(args, &conf)
+		case "DEL":
+			err = cniDel(args, &conf)
+		case "CHECK":
+			err = cniCheck(args, &conf)
+		default:
+			err = &cniError{Code: cniErrInvalidEnvironment, Msg: fmt.Sprintf("Unknown CNI_COMMAND '%s'", args.command)}
+		}
+		return err
+	}()
+
+	if err != nil {
+		ce, ok := err.(*cniError)
+		if !ok {
+			ce = &cniError{Code: cniErrPlugin, Msg: err.Error()}
+		}
+		ce.CNIVersion = conf.CNIVersion
+		if ce.CNIVersion == "" {
+			ce.CNIVersion = "1.0.0"
+		}
+		json.NewEncoder(os.Stdout).Encode(ce)
+		os.Exit(1)
+	}
+	if result != nil {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+	return nil
+}
+
+func cniVersionSupported(version string) bool {
+	for _, v := range cniSupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *CNIConfig) vlanID() string {
+	if conf.VlanID == nil {
+		return ""
+	}
+	return fmt.Sprint(conf.VlanID)
+}
+
+func (conf *CNIConfig) vlanQoS() *VlanQoS {
+	if conf.EgressQoS == "" && conf.IngressQoS == "" {
+		return nil
+	}
+	return &VlanQoS{EgressMap: conf.EgressQoS, IngressMap: conf.IngressQoS}
+}
+
+func (conf *CNIConfig) hostLink() string {
+	if conf.Master != "" {
+		return conf.Master
+	}
+	return HostLinkName
+}
+
+func cniAdd(args cniArgs, conf *CNIConfig) (result *CNIResult, err error) {
+	if args.netns == "" {
+		return nil, &cniError{Code: cniErrInvalidEnvironment, Msg: "CNI_NETNS is required"}
+	}
+	if conf.Mode != "" && conf.Mode != "macvlan" {
+		return nil, &cniError{Code: cniErrInvalidConfig, Msg: fmt.Sprintf("I do not know how to setup '%s' network", conf.Mode)}
+	}
+	c := &Container{
+		ID:     shortID(args.containerID),
+		Logger: Logger.WithFields(logrus.Fields{"ID": shortID(args.containerID)}),
+	}
+
+	parentLink, err := c.setupParentLink(conf.hostLink(), conf.vlanID(), conf.vlanQoS())
+	if err != nil {
+		return nil, err
+	}
+
+	result = &CNIResult{CNIVersion: conf.CNIVersion}
+	if len(conf.IPAM) > 0 {
+		ipamResult, ipamErr := execIPAM(args, conf)
+		if ipamErr != nil {
+			return nil, ipamErr
+		}
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+		result.DNS = ipamResult.DNS
+
+		// A failed ADD gets no DEL from the runtime, so release the lease here
+		defer func() {
+			if err == nil {
+				return
+			}
+			delArgs := args
+			delArgs.command = "DEL"
+			if _, delErr := execIPAM(delArgs, conf); delErr != nil {
+				c.Logger.Warnf("Failed releasing IPAM allocation: %s", delErr.Error())
+			}
+		}()
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
+	ns, err := netns.GetFromPath(args.netns)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening namespace '%s': %s", args.netns, err.Error())
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	_, lookupErr := net.InterfaceByName(args.ifName)
+	existed := lookupErr == nil
+
+	ifc, err := c.setupLinkInNamespace(origns, ns, parentLink, tempLinkName(args.containerID), &tenus.MacVlanOptions{
+		Dev:     args.ifName,
+		MacAddr: generateMAC(),
+		Mode:    "bridge",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		// Runs before the thread returns to the original namespace
+		defer func() {
+			if err == nil {
+				return
+			}
+			netns.Set(ns)
+			if delErr := tenus.DeleteLink(args.ifName); delErr != nil {
+				c.Logger.Warnf("Failed deleting link '%s': %s", args.ifName, delErr.Error())
+				return
+			}
+			c.Logger.Printf("Container link '%s' removed after failed setup", args.ifName)
+		}()
+	}
+	if conf.MTU > 0 {
+		if err := netlink.NetworkSetMTU(ifc, conf.MTU); err != nil {
+			return nil, fmt.Errorf("Error setting MTU: %s", err.Error())
+		}
+	}
+
+	for i := range result.IPs {
+		ip := &result.IPs[i]
+		if err := configureAddress(args.ifName, ip.Address, ""); err != nil {
+			return nil, err
+		}
+		index := 0
+		ip.Interface = &index
+		if strings.HasPrefix(conf.CNIVersion, "0.") {
+			ip.Version = "4"
+			if strings.Contains(ip.Address, ":") {
+				ip.Version = "6"
+			}
+		}
+	}
+	for _, r := range result.Routes {
+		gw := r.GW
+		if gw == "" && len(result.IPs) > 0 {
+			gw = result.IPs[0].Gateway
+		}
+		if err := netlink.AddRoute(r.Dst, "", gw, args.ifName); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("Error adding route to '%s': %s", r.Dst, err.Error())
+		}
+	}
+
+	result.Interfaces = []CNIInterface{{
+		Name:    args.ifName,
+		Mac:     ifc.HardwareAddr.String(),
+		Sandbox: args.netns,
+	}}
+	c.Logger.Printf("Container link '%s' online on '%s': %v", args.ifName, parentLink, ifc.HardwareAddr)
+	return result, nil
+}
+
+func cniDel(args cniArgs, conf *CNIConfig) error {
+	if len(conf.IPAM) > 0 {
+		if _, err := execIPAM(args, conf); err != nil {
+			return err
+		}
+	}
+	// The namespace may already be gone, which means the link is gone too
+	if args.netns == "" {
+		return nil
+	}
+	ns, err := netns.GetFromPath(args.netns)
+	if err != nil {
+		return nil
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	if _, err := net.InterfaceByName(args.ifName); err != nil {
+		return nil
+	}
+	if err := tenus.DeleteLink(args.ifName); err != nil {
+		return fmt.Errorf("Error deleting link '%s': %s", args.ifName, err.Error())
+	}
+	Logger.WithFields(logrus.Fields{"ID": shortID(args.containerID)}).Printf("Container link '%s' removed", args.ifName)
+	return nil
+}
+
+func cniCheck(args cniArgs, conf *CNIConfig) error {
+	if len(conf.IPAM) > 0 {
+		if _, err := execIPAM(args, conf); err != nil {
+			return err
+		}
+	}
+	ns, err := netns.GetFromPath(args.netns)
+	if err != nil {
+		return fmt.Errorf("Error opening namespace '%s': %s", args.netns, err.Error())
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	ifc, err := net.InterfaceByName(args.ifName)
+	if err != nil {
+		return fmt.Errorf("Container link '%s' does not exist", args.ifName)
+	}
+	if ifc.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("Container link '%s' is down", args.ifName)
+	}
+	if conf.PrevResult == nil {
+		return nil
+	}
+	for _, ip := range conf.PrevResult.IPs {
+		addr, _, err := net.ParseCIDR(ip.Address)
+		if err != nil {
+			return fmt.Errorf("Invalid address '%s' in previous result", ip.Address)
+		}
+		if !hasAddress(ifc, addr) {
+			return fmt.Errorf("Container link '%s' is missing address '%s'", args.ifName, ip.Address)
+		}
+	}
+	return nil
+}
+
+// execIPAM delegates address management to the IPAM plugin named in the
+// configuration, found on CNI_PATH.
+func execIPAM(args cniArgs, conf *CNIConfig) (*CNIResult, error) {
+	var ipam struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(conf.IPAM, &ipam); err != nil || ipam.Type == "" {
+		return nil, &cniError{Code: cniErrInvalidConfig, Msg: "IPAM configuration requires a type"}
+	}
+	var plugin string
+	for _, dir := range filepath.SplitList(args.path) {
+		if p := filepath.Join(dir, ipam.Type); fileExists(p) {
+			plugin = p
+			break
+		}
+	}
+	if plugin == "" {
+		return nil, &cniError{Code: cniErrInvalidConfig, Msg: fmt.Sprintf("IPAM plugin '%s' not found in CNI_PATH", ipam.Type)}
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(plugin)
+	// CNI_COMMAND follows args, which may differ from ours when cleaning up
+	cmd.Env = append(os.Environ(), "CNI_COMMAND="+args.command)
+	cmd.Stdin = bytes.NewReader(args.stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+	if runErr != nil {
+		var ce cniError
+		if err := json.Unmarshal(stdout.Bytes(), &ce); err == nil && ce.Msg != "" {
+			return nil, &ce
+		}
+		return nil, fmt.Errorf("IPAM plugin '%s' failed: %s", ipam.Type, runErr.Error())
+	}
+	result := &CNIResult{}
+	if args.command == "ADD" {
+		if err := json.Unmarshal(stdout.Bytes(), result); err != nil {
+			return nil, fmt.Errorf("Failed decoding IPAM result: %s", err.Error())
+		}
+	}
+	return result, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	networkLabelPrefix = "plumber.network."
+	profileLabel       = "plumber.network.profile"
+)
+
+// Profile is a named network configuration containers select with the
+// plumber.network.profile label.
+type Profile struct {
+	ContainerNetworkConfig `yaml:",inline"`
+	// LabelOverrides lists the labels, without the plumber.network. prefix,
+	// that may override the profile, e.g. 'ipaddress' or 'sysctl.*'. A single
+	// '*' allows all labels.
+	LabelOverrides []string `json:"labelOverrides,omitempty" yaml:"labelOverrides"`
+}
+
+func (p *Profile) allowsOverride(key string) bool {
+	for _, o := range p.LabelOverrides {
+		if o == "*" || o == key || (strings.HasSuffix(o, ".*") && strings.HasPrefix(key, strings.TrimSuffix(o, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlumberConfig is the configuration file given with --config.
+type PlumberConfig struct {
+	Pools []*Pool `yaml:"pools"`
+	// Vlans holds the 802.1p mappings per VLAN ID
+	Vlans map[string]*VlanQoS `yaml:"vlans"`
+	// Firewalls are named rulesets profiles and labels can refer to
+	Firewalls map[string]string   `yaml:"firewalls"`
+	Profiles  map[string]*Profile `yaml:"profiles"`
+	// Policy restricts the networks containers may request
+	Policy *Policy `yaml:"policy"`
+}
+
+var (
+	configLock    sync.RWMutex
+	plumberConfig = &PlumberConfig{}
+)
+
+func currentConfig() *PlumberConfig {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return plumberConfig
+}
+
+func setConfig(cfg *PlumberConfig) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	plumberConfig = cfg
+}
+
+// loadConfig reads and validates a configuration file
+func loadConfig(path string) (*PlumberConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &PlumberConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing '%s': %s", path, err.Error())
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration '%s': %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and normalizes it: VLAN IDs are
+// decimal and profiles refer to firewall rules instead of ruleset names.
+func (cfg *PlumberConfig) validate() error {
+	pools := make(map[string]bool)
+	for _, p := range cfg.Pools {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if pools[p.Name] {
+			return fmt.Errorf("Duplicate pool '%s'", p.Name)
+		}
+		pools[p.Name] = true
+	}
+
+	vlans := make(map[string]*VlanQoS)
+	for id, qos := range cfg.Vlans {
+		vlanID, err := strconv.ParseUint(id, 0, 12)
+		if err != nil {
+			return fmt.Errorf("Invalid VLAN ID '%s'", id)
+		}
+		if qos == nil {
+			continue
+		}
+		if err := qos.validate(); err != nil {
+			return fmt.Errorf("VLAN '%s': %s", id, err.Error())
+		}
+		vlans[fmt.Sprint(vlanID)] = qos
+	}
+	cfg.Vlans = vlans
+
+	for name, rules := range cfg.Firewalls {
+		if _, err := parseFirewall(rules); err != nil {
+			return fmt.Errorf("Firewall '%s': %s", name, err.Error())
+		}
+	}
+
+	if cfg.Policy != nil {
+		if err := cfg.Policy.validate(); err != nil {
+			return fmt.Errorf("Policy: %s", err.Error())
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := cfg.Profiles[name]
+		if p == nil {
+			return fmt.Errorf("Profile '%s' is empty", name)
+		}
+		if p.NetworkMode == "" {
+			p.NetworkMode = "macvlan"
+		}
+		if rules, ok := cfg.Firewalls[p.Firewall]; ok {
+			p.Firewall = rules
+		}
+		if err := p.ContainerNetworkConfig.validate(); err != nil {
+			return fmt.Errorf("Profile '%s': %s", name, err.Error())
+		}
+	}
+	return nil
+}
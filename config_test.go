@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestAllowsOverride(t *testing.T) {
+	for _, tt := range []struct {
+		overrides []string
+		key       string
+		allowed   bool
+	}{
+		{nil, "ipaddress", false},
+		{[]string{"ipaddress"}, "ipaddress", true},
+		{[]string{"ipaddress"}, "vlanid", false},
+		{[]string{"*"}, "vlanid", true},
+		{[]string{"sysctl.*"}, "sysctl.net.ipv4.ip_forward", true},
+		{[]string{"sysctl.*"}, "sysctl", false},
+		{[]string{"netem.*"}, "egress.rate", false},
+		{[]string{"egress.*", "ipaddress"}, "egress.burst", true},
+		{[]string{"ip*"}, "ipaddress", false},
+	} {
+		p := &Profile{LabelOverrides: tt.overrides}
+		if allowed := p.allowsOverride(tt.key); allowed != tt.allowed {
+			t.Errorf("allowsOverride(%s) with %v = %v, want %v", tt.key, tt.overrides, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := &PlumberConfig{
+		Vlans:     map[string]*VlanQoS{"0xc3e": {EgressMap: "0:3"}, "100": nil},
+		Firewalls: map[string]string{"web": "in tcp/80,tcp/443"},
+		Profiles: map[string]*Profile{
+			"web":   {ContainerNetworkConfig: ContainerNetworkConfig{Firewall: "web"}},
+			"ssh":   {ContainerNetworkConfig: ContainerNetworkConfig{Firewall: "in tcp/22"}},
+			"plain": {},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Configuration is invalid: %s", err)
+	}
+	if !reflect.DeepEqual(cfg.Vlans, map[string]*VlanQoS{"3134": {EgressMap: "0:3"}}) {
+		t.Errorf("VLANs normalized to %v", cfg.Vlans)
+	}
+	for name, want := range map[string]string{"web": "in tcp/80,tcp/443", "ssh": "in tcp/22", "plain": ""} {
+		p := cfg.Profiles[name]
+		if p.Firewall != want || p.NetworkMode != "macvlan" {
+			t.Errorf("Profile '%s' has firewall '%s' and mode '%s', want '%s' and 'macvlan'", name, p.Firewall, p.NetworkMode, want)
+		}
+	}
+
+	for _, cfg := range []*PlumberConfig{
+		{Vlans: map[string]*VlanQoS{"4096": nil}},
+		{Vlans: map[string]*VlanQoS{"100": {EgressMap: "0:8"}}},
+		{Firewalls: map[string]string{"web": "allow tcp/80"}},
+		{Profiles: map[string]*Profile{"web": nil}},
+		{Profiles: map[string]*Profile{"web": {ContainerNetworkConfig: ContainerNetworkConfig{NetworkMode: "bridge"}}}},
+		{Profiles: map[string]*Profile{"web": {ContainerNetworkConfig: ContainerNetworkConfig{Firewall: "missing"}}}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
+
+func TestGetContainerNetworkConfigProfiles(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	cfg := &PlumberConfig{
+		Firewalls: map[string]string{"web": "in tcp/80", "ssh": "in tcp/22"},
+		Profiles: map[string]*Profile{
+			"backoffice": {
+				ContainerNetworkConfig: ContainerNetworkConfig{
+					VlanID:     "3134",
+					IPAM:       "backoffice",
+					EgressRate: "100mbit",
+					Firewall:   "web",
+					Sysctls:    map[string]string{"net.ipv4.ip_forward": "0"},
+				},
+				LabelOverrides: []string{"ipaddress", "firewall", "sysctl.*"},
+			},
+			"open": {LabelOverrides: []string{"*"}},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	current := currentConfig()
+	defer setConfig(current)
+	setConfig(cfg)
+
+	for _, tt := range []struct {
+		labels map[string]string
+		want   ContainerNetworkConfig
+	}{
+		// Labels without a profile configure the network on their own
+		{map[string]string{"plumber.network.mode": "macvlan", "plumber.network.vlanid": "100", "plumber.network.firewall": "ssh"},
+			ContainerNetworkConfig{NetworkMode: "macvlan", VlanID: "100", Firewall: "in tcp/22"}},
+		// The profile applies, with the labels it allows overriding
+		{map[string]string{"plumber.network.profile": "backoffice"},
+			ContainerNetworkConfig{Profile: "backoffice", NetworkMode: "macvlan", VlanID: "3134", IPAM: "backoffice", EgressRate: "100mbit", Firewall: "in tcp/80", Sysctls: map[string]string{"net.ipv4.ip_forward": "0"}}},
+		{map[string]string{"plumber.network.profile": "backoffice", "plumber.network.ipaddress": "10.0.0.5/24", "plumber.network.vlanid": "100", "plumber.network.egress.rate": "1gbit"},
+			ContainerNetworkConfig{Profile: "backoffice", NetworkMode: "macvlan", VlanID: "3134", IPAM: "backoffice", IPAddress: "10.0.0.5/24", EgressRate: "100mbit", Firewall: "in tcp/80", Sysctls: map[string]string{"net.ipv4.ip_forward": "0"}}},
+		{map[string]string{"plumber.network.profile": "backoffice", "plumber.network.firewall": "ssh", "plumber.network.sysctl.net.ipv4.ip_forward": "1", "plumber.network.sysctl.net.core.somaxconn": "1024"},
+			ContainerNetworkConfig{Profile: "backoffice", NetworkMode: "macvlan", VlanID: "3134", IPAM: "backoffice", EgressRate: "100mbit", Firewall: "in tcp/22", Sysctls: map[string]string{"net.ipv4.ip_forward": "1", "net.core.somaxconn": "1024"}}},
+		// A firewall label that names no ruleset holds the rules itself
+		{map[string]string{"plumber.network.profile": "open", "plumber.network.firewall": "out udp/53", "plumber.network.mtu": "9000"},
+			ContainerNetworkConfig{Profile: "open", NetworkMode: "macvlan", Firewall: "out udp/53", MTU: 9000}},
+	} {
+		c := NewContainer("3f4a1c2b9d8e")
+		cn, err := c.getContainerNetworkConfig(&docker.Container{Config: &docker.Config{Labels: tt.labels}})
+		if err != nil {
+			t.Errorf("getContainerNetworkConfig(%v) failed: %s", tt.labels, err)
+			continue
+		}
+		if !reflect.DeepEqual(cn, tt.want) {
+			t.Errorf("getContainerNetworkConfig(%v) = %+v, want %+v", tt.labels, cn, tt.want)
+		}
+	}
+
+	// Overriding labels do not change the profile
+	if p := cfg.Profiles["backoffice"]; p.Sysctls["net.ipv4.ip_forward"] != "0" || p.Firewall != "in tcp/80" {
+		t.Errorf("Labels changed profile 'backoffice' to %+v", p.ContainerNetworkConfig)
+	}
+
+	for _, labels := range []map[string]string{
+		{"plumber.network.profile": "missing"},
+		{"plumber.network.profile": "open", "plumber.network.mtu": "large"},
+	} {
+		c := NewContainer("3f4a1c2b9d8e")
+		if _, err := c.getContainerNetworkConfig(&docker.Container{Config: &docker.Config{Labels: labels}}); errorClass(err) != "config" {
+			t.Errorf("getContainerNetworkConfig(%v) returned %v, want a config error", labels, err)
+		}
+	}
+}
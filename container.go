@@ -2,7 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
@@ -10,15 +17,251 @@ import (
 	"regexp"
 )
 
+var parentLinkLock sync.Mutex
+
+// lockParentLinks serializes changes to parent links, also with the attach
+// subcommand, which runs in a process of its own. It returns the unlock function.
+func lockParentLinks() func() {
+	parentLinkLock.Lock()
+	var lock *os.File
+	if StateDir != "" {
+		var err error
+		if lock, err = lockFile(filepath.Join(StateDir, "parents.lock")); err != nil {
+			Logger.Warnf("Failed locking parent links: %s", err.Error())
+		}
+	}
+	return func() {
+		if lock != nil {
+			lock.Close()
+		}
+		parentLinkLock.Unlock()
+	}
+}
+
+var ifNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
 type Container struct {
 	ID     string
 	Name   string
+	Image  string
+	Labels map[string]string
 	Logger *logrus.Entry
 }
 
 type ContainerNetworkConfig struct {
-	NetworkMode string
-	VlanID      string
+	Profile     string `json:"profile,omitempty" yaml:"-"`
+	NetworkMode string `json:"networkMode" yaml:"networkMode"`
+	// Parent is the host link to attach to instead of the --host-link one
+	Parent string `json:"parent,omitempty" yaml:"parent"`
+	// IfName is the name of the link in the container, the --host-link one by default
+	IfName      string `json:"ifname,omitempty" yaml:"ifname"`
+	VlanID      string `json:"vlanId,omitempty" yaml:"vlanId"`
+	MTU         int    `json:"mtu,omitempty" yaml:"mtu"`
+	IPAM        string `json:"ipam,omitempty" yaml:"ipam"`
+	IPAddress   string `json:"ipAddress,omitempty" yaml:"ipAddress"`
+	Gateway     string `json:"gateway,omitempty" yaml:"gateway"`
+	ProbeTarget string `json:"probe,omitempty" yaml:"probe"`
+	Firewall    string `json:"firewall,omitempty" yaml:"firewall"`
+	// Sysctls are set in the container network namespace once the link exists
+	Sysctls map[string]string `json:"sysctls,omitempty" yaml:"sysctls"`
+	// Bandwidth limits in tc notation, e.g. '100mbit' with burst '256kb'
+	EgressRate   string `json:"egressRate,omitempty" yaml:"egressRate"`
+	EgressBurst  string `json:"egressBurst,omitempty" yaml:"egressBurst"`
+	IngressRate  string `json:"ingressRate,omitempty" yaml:"ingressRate"`
+	IngressBurst string `json:"ingressBurst,omitempty" yaml:"ingressBurst"`
+	Netem        *Netem `json:"netem,omitempty" yaml:"netem"`
+	// VlanQoS sets the 802.1p mappings of a new VLAN link; the VLAN link is
+	// shared, so they must agree with the configured and current mappings
+	VlanQoS *VlanQoS `json:"vlanQos,omitempty" yaml:"vlanQos"`
+	// Mirror is a host interface that receives a copy of the container traffic,
+	// including traffic with containers on the same parent
+	Mirror string `json:"mirror,omitempty" yaml:"mirror"`
+}
+
+// labelSetters apply the plumber.network.* labels, keyed without that prefix
+var labelSetters = map[string]func(cn *ContainerNetworkConfig, v string) error{
+	"mode":      func(cn *ContainerNetworkConfig, v string) error { cn.NetworkMode = v; return nil },
+	"parent":    func(cn *ContainerNetworkConfig, v string) error { cn.Parent = v; return nil },
+	"ifname":    func(cn *ContainerNetworkConfig, v string) error { cn.IfName = v; return nil },
+	"vlanid":    func(cn *ContainerNetworkConfig, v string) error { cn.VlanID = v; return nil },
+	"ipam":      func(cn *ContainerNetworkConfig, v string) error { cn.IPAM = v; return nil },
+	"ipaddress": func(cn *ContainerNetworkConfig, v string) error { cn.IPAddress = v; return nil },
+	"gateway":   func(cn *ContainerNetworkConfig, v string) error { cn.Gateway = v; return nil },
+	"probe":     func(cn *ContainerNetworkConfig, v string) error { cn.ProbeTarget = v; return nil },
+	"firewall":  func(cn *ContainerNetworkConfig, v string) error { cn.Firewall = v; return nil },
+	"mirror":    func(cn *ContainerNetworkConfig, v string) error { cn.Mirror = v; return nil },
+	"mtu": func(cn *ContainerNetworkConfig, v string) error {
+		mtu, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid MTU '%s'", v)
+		}
+		cn.MTU = mtu
+		return nil
+	},
+	"egress.rate":   func(cn *ContainerNetworkConfig, v string) error { cn.EgressRate = v; return nil },
+	"egress.burst":  func(cn *ContainerNetworkConfig, v string) error { cn.EgressBurst = v; return nil },
+	"ingress.rate":  func(cn *ContainerNetworkConfig, v string) error { cn.IngressRate = v; return nil },
+	"ingress.burst": func(cn *ContainerNetworkConfig, v string) error { cn.IngressBurst = v; return nil },
+	"netem.delay":   func(cn *ContainerNetworkConfig, v string) error { cn.netem().Delay = v; return nil },
+	"netem.jitter":  func(cn *ContainerNetworkConfig, v string) error { cn.netem().Jitter = v; return nil },
+	"netem.loss":    func(cn *ContainerNetworkConfig, v string) error { cn.netem().Loss = v; return nil },
+	"netem.duplicate": func(cn *ContainerNetworkConfig, v string) error {
+		cn.netem().Duplicate = v
+		return nil
+	},
+	"netem.reorder": func(cn *ContainerNetworkConfig, v string) error { cn.netem().Reorder = v; return nil },
+	"vlan.egress-qos-map": func(cn *ContainerNetworkConfig, v string) error {
+		cn.vlanQoS().EgressMap = v
+		return nil
+	},
+	"vlan.ingress-qos-map": func(cn *ContainerNetworkConfig, v string) error {
+		cn.vlanQoS().IngressMap = v
+		return nil
+	},
+}
+
+// parent returns the host link the container is attached to
+func (cn *ContainerNetworkConfig) parent() string {
+	if cn.Parent != "" {
+		return cn.Parent
+	}
+	return HostLinkName
+}
+
+// ifName returns the name of the link in the container
+func (cn *ContainerNetworkConfig) ifName() string {
+	if cn.IfName != "" {
+		return cn.IfName
+	}
+	return HostLinkName
+}
+
+func (cn *ContainerNetworkConfig) netem() *Netem {
+	if cn.Netem == nil {
+		cn.Netem = &Netem{}
+	}
+	return cn.Netem
+}
+
+func (cn *ContainerNetworkConfig) vlanQoS() *VlanQoS {
+	if cn.VlanQoS == nil {
+		cn.VlanQoS = &VlanQoS{}
+	}
+	return cn.VlanQoS
+}
+
+// clone returns a copy that shares no maps or pointers with cn
+func (cn ContainerNetworkConfig) clone() ContainerNetworkConfig {
+	if cn.Sysctls != nil {
+		sysctls := make(map[string]string, len(cn.Sysctls))
+		for k, v := range cn.Sysctls {
+			sysctls[k] = v
+		}
+		cn.Sysctls = sysctls
+	}
+	if cn.Netem != nil {
+		netem := *cn.Netem
+		cn.Netem = &netem
+	}
+	if cn.VlanQoS != nil {
+		qos := *cn.VlanQoS
+		cn.VlanQoS = &qos
+	}
+	return cn
+}
+
+// applyLabels sets the fields given by plumber.network.* labels for which
+// allowed returns true, and returns the labels that were not allowed.
+func (cn *ContainerNetworkConfig) applyLabels(labels map[string]string, allowed func(key string) bool) ([]string, error) {
+	var denied []string
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, label := range keys {
+		if !strings.HasPrefix(label, networkLabelPrefix) || label == profileLabel {
+			continue
+		}
+		key := strings.TrimPrefix(label, networkLabelPrefix)
+		set, ok := labelSetters[key]
+		if !ok && strings.HasPrefix(key, "sysctl.") {
+			set = func(cn *ContainerNetworkConfig, v string) error {
+				if cn.Sysctls == nil {
+					cn.Sysctls = make(map[string]string)
+				}
+				cn.Sysctls[strings.TrimPrefix(key, "sysctl.")] = v
+				return nil
+			}
+		} else if !ok {
+			continue
+		}
+		if !allowed(key) {
+			denied = append(denied, label)
+			continue
+		}
+		if err := set(cn, labels[label]); err != nil {
+			return nil, err
+		}
+	}
+	return denied, nil
+}
+
+// validate checks the settings that do not depend on the host
+func (cn *ContainerNetworkConfig) validate() error {
+	if cn.NetworkMode != "" && cn.NetworkMode != "macvlan" {
+		return fmt.Errorf("I do not know how to setup '%s' network", cn.NetworkMode)
+	}
+	if cn.VlanID != "" {
+		if _, err := strconv.ParseUint(cn.VlanID, 0, 12); err != nil {
+			return fmt.Errorf("Invalid VLAN ID '%s': %v", cn.VlanID, err)
+		}
+	}
+	if cn.IfName != "" && !ifNamePattern.MatchString(cn.IfName) {
+		return fmt.Errorf("Invalid interface name '%s'", cn.IfName)
+	}
+	if cn.MTU != 0 && (cn.MTU < 68 || cn.MTU > 65535) {
+		return fmt.Errorf("Invalid MTU '%d'", cn.MTU)
+	}
+	if cn.Firewall != "" {
+		if _, err := parseFirewall(cn.Firewall); err != nil {
+			return err
+		}
+	}
+	if err := validateSysctls(cn.Sysctls); err != nil {
+		return err
+	}
+	if err := validateShaping(cn); err != nil {
+		return err
+	}
+	if cn.Netem != nil {
+		if err := cn.Netem.validate(); err != nil {
+			return err
+		}
+	}
+	if cn.VlanQoS != nil {
+		if err := cn.VlanQoS.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupError classifies why a container network setup failed.
+type setupError struct {
+	class string
+	err   error
+}
+
+func (e *setupError) Error() string {
+	return e.err.Error()
+}
+
+func errorClass(err error) string {
+	if se, ok := err.(*setupError); ok {
+		return se.class
+	}
+	return "unknown"
 }
 
 func NewContainer(id string) *Container {
@@ -29,7 +272,7 @@ func NewContainer(id string) *Container {
 	}
 }
 
-func (c *Container) getContainerNetworkConfig(containerInfo *docker.Container) ContainerNetworkConfig {
+func (c *Container) getContainerNetworkConfig(containerInfo *docker.Container) (ContainerNetworkConfig, error) {
 	// Check if pipework command is passed as environment variable.
 	pattern := regexp.MustCompile(`((\w*_)*pipework_cmd(_\w*)*=(.*))`)
 	for _, env := range containerInfo.Config.Env {
@@ -37,66 +280,432 @@ func (c *Container) getContainerNetworkConfig(containerInfo *docker.Container) C
 			pipeworkCMD := pattern.FindStringSubmatch(env)[4]
 			c.Logger.Debugf("Pipework CMD: %s", pipeworkCMD)
 			pattern = regexp.MustCompile(`^(\w*)( -i (\w*))? @CONTAINER_NAME@ (\S*)( @(\d+))?$`)
-			return ContainerNetworkConfig{
+			match := pattern.FindStringSubmatch(pipeworkCMD)
+			if match == nil {
+				c.Logger.Warnf("Ignoring unsupported pipework command: %s", pipeworkCMD)
+				return ContainerNetworkConfig{}, nil
+			}
+			cn := ContainerNetworkConfig{
 				NetworkMode: "macvlan",
-				VlanID:      pattern.FindStringSubmatch(pipeworkCMD)[6],
+				VlanID:      match[6],
 			}
+			// Pipework takes 'dhcp' or a static address as ip/prefix@gateway
+			if match[4] != "dhcp" && strings.Contains(match[4], "/") {
+				parts := strings.SplitN(match[4], "@", 2)
+				cn.IPAddress = parts[0]
+				if len(parts) == 2 {
+					cn.Gateway = parts[1]
+				}
+			}
+			return cn, nil
 		}
 	}
 
-	return ContainerNetworkConfig{
-		NetworkMode: containerInfo.Config.Labels["plumber.network.mode"],
-		VlanID:      containerInfo.Config.Labels["plumber.network.vlanid"],
+	labels := containerInfo.Config.Labels
+	cn := ContainerNetworkConfig{}
+	allowed := func(string) bool { return true }
+	if name := labels[profileLabel]; name != "" {
+		profile, ok := currentConfig().Profiles[name]
+		if !ok {
+			return cn, &setupError{"config", fmt.Errorf("No such network profile: %s", name)}
+		}
+		cn = profile.ContainerNetworkConfig.clone()
+		cn.Profile = name
+		allowed = profile.allowsOverride
+	}
+	denied, err := cn.applyLabels(labels, allowed)
+	if err != nil {
+		return cn, &setupError{"config", err}
+	}
+	for _, label := range denied {
+		c.Logger.Warnf("Ignoring label '%s', profile '%s' does not allow overriding it", label, cn.Profile)
 	}
+	// Labels may name a firewall ruleset from the configuration
+	if rules, ok := currentConfig().Firewalls[cn.Firewall]; ok {
+		cn.Firewall = rules
+	}
+	return cn, nil
 }
 
-func (c *Container) setupNetwork(containerName string, cn *ContainerNetworkConfig) {
+// leaseOwner keys the leases of a container by its name. Links other than the
+// default one get their own lease, e.g. 'web:eth1'.
+func leaseOwner(containerName string, cn *ContainerNetworkConfig) string {
+	owner := strings.TrimPrefix(containerName, "/")
+	if cn.IfName != "" && cn.IfName != HostLinkName {
+		owner += ":" + cn.IfName
+	}
+	return owner
+}
+
+// addressPool returns the pool the IPAM of a network config refers to
+func addressPool(cn *ContainerNetworkConfig) (*Pool, error) {
+	if cn.IPAddress != "" {
+		return nil, &setupError{"config", fmt.Errorf("Static address '%s' conflicts with IPAM '%s'", cn.IPAddress, cn.IPAM)}
+	}
+	if !strings.HasPrefix(cn.IPAM, "pool:") {
+		return nil, &setupError{"config", fmt.Errorf("Unknown IPAM '%s'", cn.IPAM)}
+	}
+	name := strings.TrimPrefix(cn.IPAM, "pool:")
+	am := currentIPAM()
+	if am == nil {
+		return nil, &setupError{"config", fmt.Errorf("No address pools configured for IPAM '%s'", cn.IPAM)}
+	}
+	pool, ok := am.Pool(name)
+	if !ok {
+		return nil, &setupError{"config", fmt.Errorf("No such pool: %s", name)}
+	}
+	if pool.VlanID != "" && pool.VlanID != cn.VlanID {
+		return nil, &setupError{"config", fmt.Errorf("Pool '%s' belongs to VLAN '%s', not '%s'", name, pool.VlanID, cn.VlanID)}
+	}
+	return pool, nil
+}
+
+// resolveAddress leases an address for the container when its network
+// config refers to an address pool, e.g. 'pool:backoffice'. Leases are keyed
+// by container name so a restarted container keeps its address.
+func (c *Container) resolveAddress(containerName string, cn *ContainerNetworkConfig) error {
+	if cn.IPAM == "" {
+		return nil
+	}
+	pool, err := addressPool(cn)
+	if err != nil {
+		return err
+	}
+	name := pool.Name
+	ip, err := currentIPAM().Allocate(name, leaseOwner(containerName, cn), "")
+	if err != nil {
+		return &setupError{"ipam", err}
+	}
+	cn.IPAddress = pool.CIDR(ip)
+	cn.Gateway = pool.Gateway
+	c.Logger.Printf("Leased address '%s' from pool '%s'", cn.IPAddress, name)
+	return nil
+}
+
+func (c *Container) setupNetwork(containerName string, cn *ContainerNetworkConfig) error {
 	switch cn.NetworkMode {
 	case "macvlan":
 		c.Logger.Printf("Setting up '%s' network for container '%s'", cn.NetworkMode, containerName)
-		c.setupMacvlanNetwork(containerName, cn)
+		return c.setupMacvlanNetwork(containerName, cn)
 	default:
-		c.Logger.Printf("I do not know how to setup '%s' network", cn.NetworkMode)
+		return &setupError{"config", fmt.Errorf("I do not know how to setup '%s' network", cn.NetworkMode)}
 	}
 }
 
-func (c *Container) setupMacvlanNetwork(containerName string, cn *ContainerNetworkConfig) {
-	parentLinkName := HostLinkName
-	if cn.VlanID != "" {
-		vlanID, _ := strconv.ParseUint(cn.VlanID, 0, 64)
-		parentLink, err := c.setupHostLink(HostLinkName, tenus.VlanOptions{
-			MacAddr: generateMAC(),
-			Dev:     fmt.Sprintf("%s.%d", HostLinkName, vlanID),
-			Id:      uint16(vlanID),
-		})
-		if err != nil {
-			c.Logger.Fatalf("Failed setting up parent link: %v", err.Error())
+// setupParentLink returns the link macvlan links are created on: the host
+// link itself, or a VLAN link on top of it when a VLAN ID is given. The 802.1p
+// mappings of the VLAN link are set to those configured for the VLAN, or to qos
+// when it does not conflict with them or with those of an existing link.
+func (c *Container) setupParentLink(hostLink string, vlanIDStr string, qos *VlanQoS) (string, error) {
+	if vlanIDStr == "" {
+		return hostLink, nil
+	}
+	vlanID, err := strconv.ParseUint(vlanIDStr, 0, 12)
+	if err != nil {
+		return "", &setupError{"config", fmt.Errorf("Invalid VLAN ID '%s': %v", vlanIDStr, err)}
+	}
+	if qos != nil {
+		if err := qos.validate(); err != nil {
+			return "", &setupError{"config", err}
+		}
+	}
+	// Serialize parent setup so concurrent containers do not race creating the same VLAN link
+	defer lockParentLinks()()
+	dev := fmt.Sprintf("%s.%d", hostLink, vlanID)
+	// A reload swaps the mappings under the same lock
+	configured := configuredVlanQoS(fmt.Sprint(vlanID))
+	if qos != nil {
+		if err := checkVlanQoS(fmt.Sprint(vlanID), dev, qos); err != nil {
+			return "", &setupError{"config", err}
+		}
+		// The configured mappings still apply to the direction qos leaves out
+		merged := VlanQoS{}
+		if configured != nil {
+			merged = *configured
+		}
+		if qos.EgressMap != "" {
+			merged.EgressMap = qos.EgressMap
 		}
-		c.Logger.Printf("Parent link '%v' online: %v", parentLink.options.Dev, parentLink.options.MacAddr)
-		parentLinkName = parentLink.name
+		if qos.IngressMap != "" {
+			merged.IngressMap = qos.IngressMap
+		}
+		configured = &merged
+	}
+	qos = configured
+	start := time.Now()
+	parentLink, err := c.setupHostLink(hostLink, tenus.VlanOptions{
+		MacAddr: generateMAC(),
+		Dev:     dev,
+		Id:      uint16(vlanID),
+	})
+	if err == nil {
+		var changed bool
+		if changed, err = applyVlanQoS(parentLink.name, qos); changed {
+			c.Logger.Printf("Set QoS mappings of '%s' to egress '%s', ingress '%s'", parentLink.name, qos.EgressMap, qos.IngressMap)
+		}
+	}
+	SetupDuration.Since(start, "parent")
+	if err != nil {
+		return "", &setupError{"parent", fmt.Errorf("Failed setting up parent link: %v", err)}
 	}
+	c.Logger.Printf("Parent link '%v' online: %v", parentLink.options.Dev, parentLink.options.MacAddr)
+	return parentLink.name, nil
+}
 
+// setupMacvlanLink leases an address when needed, sets up the parent link and
+// creates the link named cn.ifName() in the container, with MAC mac or a random
+// one. The parent link is also returned when only the container link failed.
+func (c *Container) setupMacvlanLink(containerName string, cn *ContainerNetworkConfig, mac string) (string, *MacvlanLink, error) {
+	if err := cn.validate(); err != nil {
+		return "", nil, &setupError{"config", err}
+	}
+	if cn.Mirror != "" {
+		if _, err := net.InterfaceByName(cn.Mirror); err != nil {
+			return "", nil, &setupError{"config", fmt.Errorf("Invalid mirror interface '%s': %s", cn.Mirror, err.Error())}
+		}
+	}
+	if err := c.resolveAddress(containerName, cn); err != nil {
+		return "", nil, err
+	}
+	parentLinkName, err := c.setupParentLink(cn.parent(), cn.VlanID, cn.VlanQoS)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if mac == "" {
+		mac = generateMAC()
+	}
+	start := time.Now()
 	containerLink, err := c.setupContainerLink(parentLinkName, tenus.MacVlanOptions{
-		Dev:     HostLinkName,
-		MacAddr: generateMAC(),
+		Dev:     cn.ifName(),
+		MacAddr: mac,
 		Mode:    "bridge",
-	}, containerName)
+	}, containerName, cn)
+	SetupDuration.Since(start, "namespace")
+	if err != nil {
+		class := errorClass(err)
+		if class == "unknown" {
+			class = "link"
+		}
+		return parentLinkName, nil, &setupError{class, fmt.Errorf("Failed setting up container link: %v", err)}
+	}
+	return parentLinkName, containerLink, nil
+}
+
+func (c *Container) setupMacvlanNetwork(containerName string, cn *ContainerNetworkConfig) error {
+	parentLinkName, containerLink, err := c.setupMacvlanLink(containerName, cn, "")
+	if parentLinkName != "" {
+		State.Update(c.ID, func(cs *ContainerState) {
+			cs.ParentLink = parentLinkName
+			cs.Network = *cn
+			cs.IPAddr = cn.IPAddress
+		})
+	}
 	if err != nil {
-		c.Logger.Fatalf("Failed setting up container link: %v", err.Error())
+		return err
+	}
+	State.Update(c.ID, func(cs *ContainerState) {
+		cs.MacAddr = containerLink.options.MacAddr
+		cs.NetworkStatus = containerLink.result.NetworkStatus
+		cs.NetworkStatusDetail = containerLink.result.NetworkStatusDetail
+	})
+	if NetnsDir != "" && containerLink.result.Pid != 0 {
+		if path, err := c.mountNamedNetns(containerName, containerLink.result.Pid); err != nil {
+			c.Logger.Warnf("Failed exposing network namespace: %s", err.Error())
+		} else {
+			State.Update(c.ID, func(cs *ContainerState) {
+				cs.Netns = path
+			})
+			c.audit(AuditEntry{Event: "netns.mount", Detail: path})
+		}
 	}
 	c.Logger.Printf("Container link online: %v", containerLink.options.MacAddr)
+	return nil
 }
 
-func (c *Container) handleContainerNetwork(d *docker.Client) {
+// handleContainerNetwork sets up the network a container asks for and returns
+// why that failed. Containers without a network are left alone.
+func (c *Container) handleContainerNetwork(d *docker.Client) error {
+	start := time.Now()
 	containerInfo, err := containerInfo(d, c.ID)
+	SetupDuration.Since(start, "inspect")
 	if err != nil {
 		c.Logger.Errorf("Error inspecting container: %s", err.Error())
+		// Every failure counts as an attempt, so attempts add up to the outcomes
+		SetupsAttempted.Inc("unknown")
+		SetupsFailed.Inc("unknown", "inspect")
+		return &setupError{"inspect", err}
+	}
+	if containerInfo != nil && DryRun {
+		c.logPlan(containerInfo)
+		return nil
 	}
+	// Attachments are set up after the network of the labels, whatever its outcome
+	defer c.handleAttachments(containerInfo)
 	if containerInfo != nil {
-		cn := c.getContainerNetworkConfig(containerInfo)
+		c.Name = containerInfo.Name
+		c.Image = containerInfo.Config.Image
+		c.Labels = containerInfo.Config.Labels
+		cn, err := c.getContainerNetworkConfig(containerInfo)
+		if err != nil {
+			c.Logger.Errorf("Invalid network config: %s", err.Error())
+			c.audit(AuditEntry{Event: "setup", Outcome: "failed", Reason: err.Error()})
+			SetupsAttempted.Inc("unknown")
+			SetupsFailed.Inc("unknown", errorClass(err))
+			State.Update(c.ID, func(cs *ContainerState) {
+				cs.Name = containerInfo.Name
+				cs.Status = StatusFailed
+				cs.Error = err.Error()
+			})
+			return err
+		}
 
 		if cn.NetworkMode != "" {
-			c.setupNetwork(containerInfo.Name, &cn)
+			SetupsAttempted.Inc(cn.NetworkMode)
+			if err := c.authorizeNetwork(containerInfo, &cn); err != nil {
+				c.Logger.Errorf("Refusing network setup: %s", err.Error())
+				SetupsFailed.Inc(cn.NetworkMode, errorClass(err))
+				State.Update(c.ID, func(cs *ContainerState) {
+					cs.Name = containerInfo.Name
+					cs.Network = cn
+					cs.Status = StatusFailed
+					cs.Error = err.Error()
+				})
+				return err
+			}
+			State.Update(c.ID, func(cs *ContainerState) {
+				cs.Name = containerInfo.Name
+				cs.Network = cn
+				cs.Status = StatusPending
+				cs.Error = ""
+			})
+			err := c.setupNetwork(containerInfo.Name, &cn)
+			c.auditSetup(err)
+			if err != nil {
+				c.Logger.Errorf("Failed setting up network: %s", err.Error())
+				SetupsFailed.Inc(cn.NetworkMode, errorClass(err))
+				State.Update(c.ID, func(cs *ContainerState) {
+					cs.Status = StatusFailed
+					cs.Error = err.Error()
+				})
+				return err
+			}
+			State.SetStatus(c.ID, StatusOnline)
+			SetupsSucceeded.Inc(cn.NetworkMode)
+		}
+	}
+	return nil
+}
+
+// checkPolicy evaluates the policy for the network a container requests and
+// returns the rule that decided it, with an error when it is denied
+func checkPolicy(containerInfo *docker.Container, cn *ContainerNetworkConfig) (string, error) {
+	allowed, rule := currentConfig().Policy.evaluate(&PolicyRequest{
+		Image:   containerInfo.Config.Image,
+		Labels:  containerInfo.Config.Labels,
+		Network: cn,
+	})
+	if allowed {
+		return rule, nil
+	}
+	return rule, &setupError{"policy", fmt.Errorf("Policy (%s) denies image '%s' a '%s' network on VLAN '%s' of '%s'", rule, containerInfo.Config.Image, cn.NetworkMode, cn.VlanID, cn.parent())}
+}
+
+// authorizeNetwork checks the policy for the network a container requests
+// and records denials in the audit log.
+func (c *Container) authorizeNetwork(containerInfo *docker.Container, cn *ContainerNetworkConfig) error {
+	rule, err := checkPolicy(containerInfo, cn)
+	if err == nil {
+		return nil
+	}
+	c.audit(AuditEntry{
+		Event:   "policy",
+		Mode:    cn.NetworkMode,
+		Parent:  cn.parent(),
+		VlanID:  cn.VlanID,
+		Outcome: "denied",
+		Reason:  rule,
+	})
+	return err
+}
+
+// auditSetup records the outcome of a network setup with what the state knows
+// about the container link
+func (c *Container) auditSetup(err error) {
+	cs, _ := State.Container(c.ID)
+	e := AuditEntry{
+		Event:   "setup",
+		Mode:    cs.Network.NetworkMode,
+		Parent:  cs.ParentLink,
+		VlanID:  cs.Network.VlanID,
+		Link:    cs.Network.ifName(),
+		MacAddr: cs.MacAddr,
+		IPAddr:  cs.IPAddr,
+	}
+	if err != nil {
+		e.Outcome, e.Reason = "failed", err.Error()
+	}
+	c.audit(e)
+}
+
+// auditStop records that the link of a plumbed container went away with its
+// network namespace
+func (c *Container) auditStop(reason string) {
+	cs, ok := State.Container(c.ID)
+	if !ok || cs.Status != StatusOnline {
+		return
+	}
+	if c.Name == "" {
+		c.Name = cs.Name
+	}
+	c.audit(AuditEntry{
+		Event:   "link.remove",
+		Mode:    cs.Network.NetworkMode,
+		Parent:  cs.ParentLink,
+		VlanID:  cs.Network.VlanID,
+		Link:    cs.Network.ifName(),
+		MacAddr: cs.MacAddr,
+		IPAddr:  cs.IPAddr,
+		Reason:  reason,
+	})
+}
+
+// updateNetem changes the network impairment of a plumbed container at runtime.
+// Only the qdiscs of the link are replaced; the link and its address are kept.
+func (c *Container) updateNetem(cs ContainerState, netem *Netem) error {
+	if cs.Status != StatusOnline {
+		return fmt.Errorf("Container '%s' is %s", cs.Name, cs.Status)
+	}
+	if netem != nil {
+		if err := netem.validate(); err != nil {
+			return &setupError{"config", err}
 		}
 	}
+	cn := cs.Network
+	cn.Netem = netem
+	c.Name = cs.Name
+	if err := c.shapeContainerLink(cs.Name, &cn, &cs.Network); err != nil {
+		return err
+	}
+	State.Update(c.ID, func(cs *ContainerState) {
+		cs.Network.Netem = netem
+	})
+	c.Logger.Printf("Updated netem of container '%s'", cs.Name)
+	return nil
+}
+
+// releaseAddresses returns the addresses leased to the links of a destroyed
+// container to their pools.
+func (c *Container) releaseAddresses() {
+	am := currentIPAM()
+	if am == nil || c.Name == "" {
+		return
+	}
+	released, err := am.ReleaseContainer(strings.TrimPrefix(c.Name, "/"))
+	if err != nil {
+		c.Logger.Errorf("Failed releasing addresses: %s", err.Error())
+	}
+	for _, l := range released {
+		c.Logger.Printf("Released address '%s' to pool '%s'", l.Address, l.Pool)
+	}
 }
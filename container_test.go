@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestLeaseOwner(t *testing.T) {
+	defer func(name string) { HostLinkName = name }(HostLinkName)
+	HostLinkName = "eth1"
+	for _, tt := range []struct {
+		container string
+		ifName    string
+		want      string
+	}{
+		{"/web", "", "web"},
+		{"web", "", "web"},
+		{"/web", "eth1", "web"},
+		{"/web", "eth2", "web:eth2"},
+		{"db", "backend0", "db:backend0"},
+	} {
+		if got := leaseOwner(tt.container, &ContainerNetworkConfig{IfName: tt.ifName}); got != tt.want {
+			t.Errorf("leaseOwner(%s, %s) = %s, want %s", tt.container, tt.ifName, got, tt.want)
+		}
+	}
+}
+
+func TestResolveAddress(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	defer func(name string) { HostLinkName = name }(HostLinkName)
+	HostLinkName = "eth1"
+	defer setIPAM(currentIPAM())
+
+	setIPAM(nil)
+	c := NewContainer("3f4a1c2b9d8e")
+	if err := c.resolveAddress("/web", &ContainerNetworkConfig{IPAM: "pool:backoffice"}); errorClass(err) != "config" {
+		t.Errorf("Resolving without pools returned %v, want a config error", err)
+	}
+
+	am, cleanup := testAddressManager(t,
+		"name=backoffice,vlanid=3134,subnet=10.0.0.0/24,gateway=10.0.0.1",
+		"name=p2p,subnet=10.0.1.0/31")
+	defer cleanup()
+	setIPAM(am)
+	for _, tt := range []struct {
+		container string
+		cn        ContainerNetworkConfig
+		address   string
+		gateway   string
+		class     string
+	}{
+		{"/web", ContainerNetworkConfig{}, "", "", ""},
+		{"/web", ContainerNetworkConfig{IPAddress: "10.0.2.5/24"}, "10.0.2.5/24", "", ""},
+		{"/web", ContainerNetworkConfig{IPAM: "pool:backoffice", VlanID: "3134"}, "10.0.0.2/24", "10.0.0.1", ""},
+		// A restarted container keeps its address, another link gets its own
+		{"/web", ContainerNetworkConfig{IPAM: "pool:backoffice", VlanID: "3134"}, "10.0.0.2/24", "10.0.0.1", ""},
+		{"/web", ContainerNetworkConfig{IPAM: "pool:backoffice", VlanID: "3134", IfName: "eth2"}, "10.0.0.3/24", "10.0.0.1", ""},
+		{"/db", ContainerNetworkConfig{IPAM: "pool:p2p"}, "10.0.1.0/31", "", ""},
+		{"/cache", ContainerNetworkConfig{IPAM: "pool:p2p"}, "10.0.1.1/31", "", ""},
+		{"/queue", ContainerNetworkConfig{IPAM: "pool:p2p"}, "", "", "ipam"},
+		{"/web", ContainerNetworkConfig{IPAM: "pool:backoffice", VlanID: "3135"}, "", "", "config"},
+		{"/web", ContainerNetworkConfig{IPAM: "pool:backoffice", VlanID: "3134", IPAddress: "10.0.0.9/24"}, "", "", "config"},
+		{"/web", ContainerNetworkConfig{IPAM: "pool:frontoffice"}, "", "", "config"},
+		{"/web", ContainerNetworkConfig{IPAM: "dhcp"}, "", "", "config"},
+	} {
+		cn := tt.cn
+		err := c.resolveAddress(tt.container, &cn)
+		if tt.class != "" {
+			if errorClass(err) != tt.class {
+				t.Errorf("resolveAddress(%s, %+v) returned %v, want a %s error", tt.container, tt.cn, err, tt.class)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveAddress(%s, %+v) failed: %s", tt.container, tt.cn, err)
+			continue
+		}
+		if cn.IPAddress != tt.address || cn.Gateway != tt.gateway {
+			t.Errorf("resolveAddress(%s, %+v) set %s via %s, want %s via %s", tt.container, tt.cn, cn.IPAddress, cn.Gateway, tt.address, tt.gateway)
+		}
+	}
+}
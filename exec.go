@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netns"
+)
+
+func execCommand() cli.Command {
+	return cli.Command{
+		Name:            "exec",
+		Usage:           "Run a host command in the network namespace of a container",
+		ArgsUsage:       "<container> -- <command> [arguments...]",
+		SkipFlagParsing: true,
+		Action:          runExec,
+	}
+}
+
+// execArgs splits the arguments of exec into the container and the command;
+// the '--' between them is optional
+func execArgs(args []string) (string, []string, bool) {
+	if len(args) > 1 && args[1] == "--" {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		return "", nil, false
+	}
+	return args[0], args[1:], true
+}
+
+func runExec(ctx *cli.Context) error {
+	container, command, ok := execArgs(ctx.Args())
+	if !ok {
+		return cli.NewExitError("Usage: plumber exec <container> -- <command> [arguments...]", 1)
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 127)
+	}
+
+	ns, _, err := containerNetns(container, ctx.GlobalString("docker-host"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// The command replaces plumber on this thread and inherits its namespace
+	runtime.LockOSThread()
+	if err := netns.Set(ns); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error entering container namespace: %s", err.Error()), 1)
+	}
+	ns.Close()
+	if err := syscall.Exec(path, command, os.Environ()); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error executing '%s': %s", path, err.Error()), 126)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args      []string
+		container string
+		command   []string
+	}{
+		{[]string{"web", "--", "ip", "addr"}, "web", []string{"ip", "addr"}},
+		{[]string{"web", "ip", "addr"}, "web", []string{"ip", "addr"}},
+		{[]string{"web", "--", "tcpdump", "--", "-i", "eth1"}, "web", []string{"tcpdump", "--", "-i", "eth1"}},
+		{[]string{"web", "--", "--"}, "web", []string{"--"}},
+		{[]string{"web", "--"}, "", nil},
+		{[]string{"web"}, "", nil},
+		{nil, "", nil},
+	} {
+		container, command, ok := execArgs(tt.args)
+		if ok != (tt.command != nil) || container != tt.container || !reflect.DeepEqual(command, tt.command) {
+			t.Errorf("execArgs(%q) = %s, %q, %v, want %s, %q", tt.args, container, command, ok, tt.container, tt.command)
+		}
+	}
+}
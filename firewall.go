@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// FirewallRule allows traffic in one direction, optionally limited to
+// protocols/ports and to peer networks.
+type FirewallRule struct {
+	Direction string
+	// Ports maps a protocol to its ports; an empty list allows the whole protocol
+	Ports map[string][]string
+	Peers []string
+}
+
+// Firewall is the rule set programmed for a container link. Inbound traffic
+// on the link is denied by default; outbound traffic only when there are
+// outbound rules. Other links in the namespace are not filtered.
+type Firewall struct {
+	Rules []FirewallRule
+}
+
+var firewallProtocols = map[string]string{
+	"tcp":  "tcp",
+	"udp":  "udp",
+	"icmp": "icmp",
+	"any":  "",
+}
+
+// parseFirewall parses a firewall label, e.g.
+// 'in tcp/22 10.0.0.0/8; in tcp/80,tcp/443; out udp/53; out 10.20.0.0/16'
+// Each rule has a direction followed by comma separated lists of protocols
+// or protocol/port(-range) and of peer addresses or networks.
+func parseFirewall(s string) (*Firewall, error) {
+	fw := &Firewall{}
+	for _, r := range strings.Split(s, ";") {
+		fields := strings.Fields(r)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := FirewallRule{Direction: fields[0], Ports: make(map[string][]string)}
+		if rule.Direction != "in" && rule.Direction != "out" {
+			return nil, fmt.Errorf("Firewall rule '%s' must start with 'in' or 'out'", strings.TrimSpace(r))
+		}
+		for _, field := range fields[1:] {
+			for _, item := range strings.Split(field, ",") {
+				if item == "" {
+					continue
+				}
+				if err := rule.add(item); err != nil {
+					return nil, err
+				}
+			}
+		}
+		fw.Rules = append(fw.Rules, rule)
+	}
+	if len(fw.Rules) == 0 {
+		return nil, fmt.Errorf("Firewall '%s' has no rules", s)
+	}
+	return fw, nil
+}
+
+func (r *FirewallRule) add(item string) error {
+	if _, _, err := net.ParseCIDR(item); err == nil {
+		r.Peers = append(r.Peers, item)
+		return nil
+	}
+	if ip := net.ParseIP(item); ip != nil {
+		r.Peers = append(r.Peers, item)
+		return nil
+	}
+	parts := strings.SplitN(item, "/", 2)
+	proto, ok := firewallProtocols[parts[0]]
+	if !ok {
+		return fmt.Errorf("Invalid firewall item '%s'", item)
+	}
+	if len(parts) == 1 {
+		r.Ports[proto] = nil
+		return nil
+	}
+	if proto != "tcp" && proto != "udp" {
+		return fmt.Errorf("Protocol '%s' has no ports in '%s'", parts[0], item)
+	}
+	for _, p := range strings.SplitN(parts[1], "-", 2) {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("Invalid port in firewall item '%s'", item)
+		}
+	}
+	r.Ports[proto] = append(r.Ports[proto], parts[1])
+	return nil
+}
+
+// statements renders the nft statements for the rule in its chain
+func (r *FirewallRule) statements() []string {
+	peerKey := "saddr"
+	if r.Direction == "out" {
+		peerKey = "daddr"
+	}
+	var peerMatches []string
+	var v4, v6 []string
+	for _, p := range r.Peers {
+		if strings.Contains(p, ":") {
+			v6 = append(v6, p)
+		} else {
+			v4 = append(v4, p)
+		}
+	}
+	if len(v4) > 0 {
+		peerMatches = append(peerMatches, fmt.Sprintf("ip %s { %s } ", peerKey, strings.Join(v4, ", ")))
+	}
+	if len(v6) > 0 {
+		peerMatches = append(peerMatches, fmt.Sprintf("ip6 %s { %s } ", peerKey, strings.Join(v6, ", ")))
+	}
+	if len(peerMatches) == 0 {
+		peerMatches = []string{""}
+	}
+
+	var portMatches []string
+	for _, proto := range []string{"tcp", "udp", "icmp", ""} {
+		ports, ok := r.Ports[proto]
+		if !ok {
+			continue
+		}
+		switch {
+		case proto == "":
+			portMatches = append(portMatches, "")
+		case proto == "icmp":
+			portMatches = append(portMatches, "meta l4proto { icmp, ipv6-icmp } ")
+		case len(ports) == 0:
+			portMatches = append(portMatches, fmt.Sprintf("meta l4proto %s ", proto))
+		default:
+			portMatches = append(portMatches, fmt.Sprintf("%s dport { %s } ", proto, strings.Join(ports, ", ")))
+		}
+	}
+	if len(portMatches) == 0 {
+		portMatches = []string{""}
+	}
+
+	var stmts []string
+	for _, peer := range peerMatches {
+		for _, port := range portMatches {
+			stmts = append(stmts, peer+port+"accept")
+		}
+	}
+	return stmts
+}
+
+// firewallTable declares the plumber table with the chains of a link, so the
+// statements that follow work whether they exist yet or not. The base chains
+// jump to the chains of a link through the input_links and output_links maps,
+// keyed by link name.
+func firewallTable(ifName string) string {
+	return fmt.Sprintf(`table inet plumber {
+	map input_links { type ifname : verdict; }
+	map output_links { type ifname : verdict; }
+	chain input { type filter hook input priority 0; policy accept; }
+	chain output { type filter hook output priority 0; policy accept; }
+	chain in_%[1]s { }
+	chain out_%[1]s { }
+}
+add element inet plumber input_links { "%[1]s" : jump in_%[1]s }
+add element inet plumber output_links { "%[1]s" : jump out_%[1]s }
+`, ifName)
+}
+
+// Ruleset renders the firewall as an nft script replacing the chains of the
+// link ifName in the plumber table; the chains of other links are kept
+func (fw *Firewall) Ruleset(ifName string) string {
+	var b bytes.Buffer
+	b.WriteString(firewallTable(ifName))
+	for _, chain := range []string{"input", "output", "in_" + ifName, "out_" + ifName} {
+		fmt.Fprintf(&b, "flush chain inet plumber %s\n", chain)
+	}
+	b.WriteString("table inet plumber {\n")
+	b.WriteString("\tchain input {\n\t\tiifname vmap @input_links\n\t}\n")
+	b.WriteString("\tchain output {\n\t\toifname vmap @output_links\n\t}\n")
+	for _, chain := range []struct{ prefix, direction string }{{"in_", "in"}, {"out_", "out"}} {
+		verdict := "drop"
+		var rules []string
+		for _, r := range fw.Rules {
+			if r.Direction == chain.direction {
+				rules = append(rules, r.statements()...)
+			}
+		}
+		if chain.direction == "out" && len(rules) == 0 {
+			verdict = "accept"
+		}
+		fmt.Fprintf(&b, "\tchain %s%s {\n", chain.prefix, ifName)
+		b.WriteString("\t\tct state established,related accept\n")
+		b.WriteString("\t\tct state invalid drop\n")
+		// Neighbor discovery must keep working for IPv6
+		b.WriteString("\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit, nd-router-advert } accept\n")
+		for _, r := range rules {
+			fmt.Fprintf(&b, "\t\t%s\n", r)
+		}
+		fmt.Fprintf(&b, "\t\t%s\n", verdict)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// firewallRemoval renders an nft script deleting the chains of the link ifName
+func firewallRemoval(ifName string) string {
+	var b bytes.Buffer
+	b.WriteString(firewallTable(ifName))
+	fmt.Fprintf(&b, "delete element inet plumber input_links { \"%s\" }\n", ifName)
+	fmt.Fprintf(&b, "delete element inet plumber output_links { \"%s\" }\n", ifName)
+	for _, chain := range []string{"in_" + ifName, "out_" + ifName} {
+		fmt.Fprintf(&b, "flush chain inet plumber %s\ndelete chain inet plumber %s\n", chain, chain)
+	}
+	return b.String()
+}
+
+// applyFirewall loads the ruleset of the link ifName with nft. The calling
+// thread must be in the container network namespace, which the nft process
+// inherits.
+func applyFirewall(fw *Firewall, ifName string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fw.Ruleset(ifName))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error loading firewall rules: %s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// removeFirewall deletes the rules of the link ifName, if any, from the
+// current namespace
+func removeFirewall(ifName string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(firewallRemoval(ifName))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error removing firewall rules: %s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
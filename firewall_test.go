@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFirewall(t *testing.T) {
+	for _, tt := range []struct {
+		label      string
+		statements [][]string
+	}{
+		{"in tcp/22 10.0.0.0/8", [][]string{{"ip saddr { 10.0.0.0/8 } tcp dport { 22 } accept"}}},
+		{"in tcp/80,tcp/443; out udp/53", [][]string{{"tcp dport { 80, 443 } accept"}, {"udp dport { 53 } accept"}}},
+		{"out 10.20.0.0/16,fd00::/64", [][]string{{"ip daddr { 10.20.0.0/16 } accept", "ip6 daddr { fd00::/64 } accept"}}},
+		{"in tcp udp/1000-2000 192.168.1.10", [][]string{{"ip saddr { 192.168.1.10 } meta l4proto tcp accept", "ip saddr { 192.168.1.10 } udp dport { 1000-2000 } accept"}}},
+		{" in icmp ;; out any ", [][]string{{"meta l4proto { icmp, ipv6-icmp } accept"}, {"accept"}}},
+		{"", nil},
+		{" ; ", nil},
+		{"allow tcp/22", nil},
+		{"in sctp/22", nil},
+		{"in icmp/8", nil},
+		{"in tcp/0", nil},
+		{"in tcp/65536", nil},
+		{"in tcp/http", nil},
+		{"in tcp/22-", nil},
+		{"in 10.0.0.0/33", nil},
+	} {
+		fw, err := parseFirewall(tt.label)
+		if tt.statements == nil {
+			if err == nil {
+				t.Errorf("parseFirewall(%s) succeeded, want an error", tt.label)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFirewall(%s) failed: %s", tt.label, err)
+			continue
+		}
+		var statements [][]string
+		for _, r := range fw.Rules {
+			statements = append(statements, r.statements())
+		}
+		if !reflect.DeepEqual(statements, tt.statements) {
+			t.Errorf("parseFirewall(%s) rules render %q, want %q", tt.label, statements, tt.statements)
+		}
+	}
+}
+
+// firewallChain returns the lines of a chain in a ruleset, without indentation
+func firewallChain(ruleset string, chain string) []string {
+	var lines []string
+	in := false
+	for _, line := range strings.Split(ruleset, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "chain "+chain+" {":
+			in = true
+		case in && line == "}":
+			return lines
+		case in:
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestFirewallRuleset(t *testing.T) {
+	preamble := []string{
+		"ct state established,related accept",
+		"ct state invalid drop",
+		"icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit, nd-router-advert } accept",
+	}
+	for _, tt := range []struct {
+		label   string
+		in, out []string
+	}{
+		// Inbound traffic is denied by default, outbound only when there are outbound rules
+		{"in tcp/22", []string{"tcp dport { 22 } accept", "drop"}, []string{"accept"}},
+		{"out udp/53", []string{"drop"}, []string{"udp dport { 53 } accept", "drop"}},
+		{"in tcp/80; in 10.0.0.1", []string{"tcp dport { 80 } accept", "ip saddr { 10.0.0.1 } accept", "drop"}, []string{"accept"}},
+	} {
+		fw, err := parseFirewall(tt.label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleset := fw.Ruleset("eth1")
+		if got, want := firewallChain(ruleset, "in_eth1"), append(append([]string{}, preamble...), tt.in...); !reflect.DeepEqual(got, want) {
+			t.Errorf("Ruleset(%s) has in_eth1 %q, want %q", tt.label, got, want)
+		}
+		if got, want := firewallChain(ruleset, "out_eth1"), append(append([]string{}, preamble...), tt.out...); !reflect.DeepEqual(got, want) {
+			t.Errorf("Ruleset(%s) has out_eth1 %q, want %q", tt.label, got, want)
+		}
+		for _, line := range []string{
+			`add element inet plumber input_links { "eth1" : jump in_eth1 }`,
+			`add element inet plumber output_links { "eth1" : jump out_eth1 }`,
+			"flush chain inet plumber in_eth1",
+			"flush chain inet plumber out_eth1",
+			"iifname vmap @input_links",
+			"oifname vmap @output_links",
+		} {
+			if !strings.Contains(ruleset, line) {
+				t.Errorf("Ruleset(%s) lacks '%s'", tt.label, line)
+			}
+		}
+		// The chains of other links are kept
+		if strings.Contains(ruleset, "eth0") {
+			t.Errorf("Ruleset(%s) touches other links:\n%s", tt.label, ruleset)
+		}
+	}
+
+	removal := firewallRemoval("eth1")
+	for _, line := range []string{
+		`delete element inet plumber input_links { "eth1" }`,
+		"delete chain inet plumber in_eth1",
+		"delete chain inet plumber out_eth1",
+	} {
+		if !strings.Contains(removal, line) {
+			t.Errorf("firewallRemoval lacks '%s'", line)
+		}
+	}
+}
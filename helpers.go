@@ -2,11 +2,17 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/urfave/cli"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func generateMAC() string {
@@ -39,10 +45,255 @@ func initializeApp() *cli.App {
 			Value: "eth0",
 			Usage: "The name of the host link",
 		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Value: "/var/lib/plumber",
+			Usage: "Directory where plumber persists its state",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "A YAML file with network profiles, address pools, VLAN QoS mappings and firewall rulesets",
+		},
+		cli.BoolFlag{
+			Name:  "reconcile-on-reload",
+			Usage: "Set up containers whose profile changed again when the configuration is reloaded",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "A file plumber appends a JSON line to for every network change it makes",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-size",
+			Value: 100,
+			Usage: "Size in MB at which the audit log is rotated, 0 disables rotation",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-files",
+			Value: 5,
+			Usage: "Rotated audit logs to keep",
+		},
+		cli.StringFlag{
+			Name:  "netns-dir",
+			Usage: "Directory where container network namespaces are mounted by container name, e.g. /var/run/netns for 'ip netns', disabled by default",
+		},
+		cli.StringSliceFlag{
+			Name:  "vlan-qos",
+			Usage: "802.1p priority mappings of a VLAN, e.g. 'vlanid=3134,egress=0:3 1:5,ingress=5:5'",
+		},
+		cli.StringSliceFlag{
+			Name:  "pool",
+			Usage: "An address pool, e.g. name=backoffice,vlanid=3134,subnet=10.0.0.0/24,gateway=10.0.0.1,range=10.0.0.100-10.0.0.200,exclude=10.0.0.150",
+		},
+		cli.IntFlag{
+			Name:  "dad-probes",
+			Value: 3,
+			Usage: "ARP probes sent before assigning a static IPv4 address, 0 disables duplicate address detection",
+		},
+		cli.DurationFlag{
+			Name:  "dad-interval",
+			Value: time.Second,
+			Usage: "Interval between duplicate address detection probes",
+		},
+		cli.IntFlag{
+			Name:  "garp-count",
+			Value: 3,
+			Usage: "Gratuitous ARPs and unsolicited neighbor advertisements sent after assigning a static address, 0 disables them",
+		},
+		cli.DurationFlag{
+			Name:  "garp-interval",
+			Value: 500 * time.Millisecond,
+			Usage: "Interval between gratuitous ARPs",
+		},
+		cli.BoolFlag{
+			Name:  "verify-connectivity",
+			Usage: "Probe the gateway of containers with a static address after setup",
+		},
+		cli.DurationFlag{
+			Name:  "probe-timeout",
+			Value: 3 * time.Second,
+			Usage: "How long connectivity probes wait for an answer",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Log the network changes plumber would make for containers instead of making them",
+		},
+		cli.StringFlag{
+			Name:  "plugin-socket",
+			Usage: "Serve the docker network plugin on a unix connection string, e.g. unix:///run/docker/plugins/plumber.sock",
+		},
+		cli.StringFlag{
+			Name:  "api",
+			Usage: "Serve the status API and metrics on a tcp or unix connection string, e.g. tcp://127.0.0.1:8484",
+		},
+	}
+	app.Commands = []cli.Command{
+		cniCommand(),
+		captureCommand(),
+		execCommand(),
+		planCommand(),
+		syncCommand(),
+		attachCommand(),
+		detachCommand(),
 	}
 	return app
 }
 
+// shortID truncates a docker ID to the 12 characters docker displays
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[0:12]
+	}
+	return id
+}
+
+// tempLinkName is the name a link has on the host before it is moved into a container
+func tempLinkName(id string) string {
+	if len(id) > 8 {
+		id = id[0:8]
+	}
+	return "mcv" + id
+}
+
+// readJSONFile decodes path into v; a missing file leaves v untouched
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// lockFile takes an exclusive lock on path, which is created when missing, so
+// the daemon and the subcommands can share a state file. Closing the returned
+// file releases the lock.
+func lockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeJSONFile atomically replaces path with the JSON encoding of v
+func writeJSONFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// initializeVlanQoS merges the VLAN QoS flags over the configured mappings
+func initializeVlanQoS(configured map[string]*VlanQoS, flags []string) (map[string]*VlanQoS, error) {
+	config := make(map[string]*VlanQoS)
+	for vlanID, qos := range configured {
+		config[vlanID] = qos
+	}
+	for _, f := range flags {
+		vlanID, qos, err := parseVlanQoSFlag(f)
+		if err != nil {
+			return nil, err
+		}
+		config[vlanID] = qos
+	}
+	return config, nil
+}
+
+// collectPools appends the pools given by flags to the configured ones
+func collectPools(configured []*Pool, poolFlags []string) ([]*Pool, error) {
+	pools := append([]*Pool{}, configured...)
+	for _, f := range poolFlags {
+		p, err := parsePoolFlag(f)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+func initializeIPAM(stateDir string, configured []*Pool, poolFlags []string) (*AddressManager, error) {
+	pools, err := collectPools(configured, poolFlags)
+	if err != nil {
+		return nil, err
+	}
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	return NewAddressManager(stateDir, pools)
+}
+
+// initializeGlobals sets the globals from the global flags and loads the
+// configuration, VLAN QoS mappings, address pools and audit log
+func initializeGlobals(c *cli.Context) error {
+	DockerHost = c.GlobalString("docker-host")
+	HostLinkName = c.GlobalString("host-link")
+	StateDir = c.GlobalString("state-dir")
+	NetnsDir = c.GlobalString("netns-dir")
+	DADProbes = c.GlobalInt("dad-probes")
+	DADInterval = c.GlobalDuration("dad-interval")
+	GARPCount = c.GlobalInt("garp-count")
+	GARPInterval = c.GlobalDuration("garp-interval")
+	VerifyConnectivity = c.GlobalBool("verify-connectivity")
+	ProbeTimeout = c.GlobalDuration("probe-timeout")
+	DryRun = c.GlobalBool("dry-run")
+
+	if path := c.GlobalString("config"); path != "" {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			return fmt.Errorf("Failed loading configuration: %s", err.Error())
+		}
+		setConfig(cfg)
+	}
+	cfg := currentConfig()
+
+	qos, err := initializeVlanQoS(cfg.Vlans, c.GlobalStringSlice("vlan-qos"))
+	if err != nil {
+		return fmt.Errorf("Failed parsing VLAN QoS mappings: %s", err.Error())
+	}
+	setVlanQoSConfig(qos)
+
+	am, err := initializeIPAM(StateDir, cfg.Pools, c.GlobalStringSlice("pool"))
+	if err != nil {
+		return fmt.Errorf("Failed initializing address pools: %s", err.Error())
+	}
+	setIPAM(am)
+	Attachments = NewAttachmentStore(StateDir)
+
+	if path := c.GlobalString("audit-log"); path != "" {
+		audit, err := openAuditLog(path, int64(c.GlobalInt("audit-log-max-size"))<<20, c.GlobalInt("audit-log-max-files"))
+		if err != nil {
+			return fmt.Errorf("Failed opening audit log: %s", err.Error())
+		}
+		Audit = audit
+	}
+	return nil
+}
+
 func initializeLogger() {
 	Logger = logrus.New()
 	Logger.Level = logrus.InfoLevel
@@ -94,17 +345,38 @@ func getDockerHostPath(d string) string {
 
 func processIncomingEvents(events chan *docker.APIEvents, d *docker.Client) {
 	Logger.Println("Start listening for docker events")
+	setEventStream(d)
 	for {
 		select {
-		case event := <-events:
+		case event, ok := <-events:
+			if !ok {
+				// The docker client closes the stream after its reconnects failed
+				setEventStream(nil)
+				Logger.Fatalln("Docker event stream closed")
+			}
 			go func(event *docker.APIEvents) {
-				if event.Type == "container" {
+				// Exec actions carry the command, e.g. 'exec_start: sh'
+				EventsReceived.Inc(strings.SplitN(event.Action, ":", 2)[0])
+				// A dry run changes nothing, so there is nothing to clean up
+				if event.Type == "container" && !(DryRun && event.Action != "start") {
 					c := NewContainer(event.Actor.ID[0:12])
 					c.Name = event.Actor.Attributes["name"]
 					switch event.Action {
 					case "start":
 						c.Logger.Printf("Container '%s' event -> '%s'", c.Name, event.Action)
 						c.handleContainerNetwork(d)
+					case "die":
+						c.auditStop("container stopped")
+						c.removeMirror()
+						c.removeNamedNetns()
+						State.SetStatus(c.ID, StatusStopped)
+						c.stopAttachments()
+					case "destroy":
+						c.removeMirror()
+						c.removeNamedNetns()
+						State.Remove(c.ID)
+						c.stopAttachments()
+						c.releaseAddresses()
 					}
 				}
 			}(event)
@@ -113,19 +385,16 @@ func processIncomingEvents(events chan *docker.APIEvents, d *docker.Client) {
 }
 
 func processExistingContainers(d *docker.Client) {
-	containers, err := d.ListContainers(docker.ListContainersOptions{All: true})
+	Logger.Println("Processing existing containers")
+	results, err := syncContainers(d, docker.ListContainersOptions{All: true})
 	if err != nil {
 		Logger.Fatalf("Failed to get containers: %v", err)
 	}
-
-	Logger.Println("Processing existing containers")
-	for _, container := range containers {
-		go func(container docker.APIContainers) {
-			if container.State == "running" {
-				c := NewContainer(container.ID[0:12])
-				c.handleContainerNetwork(d)
-			}
-		}(container)
+	failed := 0
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			failed++
+		}
 	}
-	Logger.Println("All existing containers have been processed")
+	Logger.Printf("All existing containers have been processed, %d of %d failed", failed, len(results))
 }
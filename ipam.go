@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool is a range of IPv4 addresses plumber hands out on a VLAN.
+type Pool struct {
+	Name    string   `json:"name" yaml:"name"`
+	VlanID  string   `json:"vlanId,omitempty" yaml:"vlanId"`
+	Subnet  string   `json:"subnet" yaml:"subnet"`
+	Gateway string   `json:"gateway,omitempty" yaml:"gateway"`
+	Range   string   `json:"range,omitempty" yaml:"range"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude"`
+
+	network  *net.IPNet
+	gateway  net.IP
+	first    uint32
+	last     uint32
+	excluded []ipRange
+}
+
+type ipRange struct {
+	first uint32
+	last  uint32
+}
+
+// Lease records which owner holds an address. Owners are container names for
+// label driven containers and 'docker' for addresses handed to docker.
+type Lease struct {
+	Pool      string    `json:"pool"`
+	Address   string    `json:"address"`
+	Owner     string    `json:"owner"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// AddressManager allocates addresses from pools and persists the leases. The
+// daemon and the attach, detach and sync subcommands share the leases file, so
+// every access locks it and reads the leases again.
+type AddressManager struct {
+	sync.Mutex
+	path   string
+	pools  map[string]*Pool
+	leases []Lease
+}
+
+var (
+	ipamLock sync.RWMutex
+	// addressManager is nil when no pools are configured
+	addressManager *AddressManager
+)
+
+func currentIPAM() *AddressManager {
+	ipamLock.RLock()
+	defer ipamLock.RUnlock()
+	return addressManager
+}
+
+func setIPAM(am *AddressManager) {
+	ipamLock.Lock()
+	defer ipamLock.Unlock()
+	addressManager = am
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("Invalid IPv4 address '%s'", s)
+	}
+	return ip.To4(), nil
+}
+
+// parseIPRange parses a single address or a first-last range
+func parseIPRange(s string) (ipRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := parseIPv4(parts[0])
+	if err != nil {
+		return ipRange{}, err
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = parseIPv4(parts[1]); err != nil {
+			return ipRange{}, err
+		}
+	}
+	r := ipRange{ipToUint(first), ipToUint(last)}
+	if r.first > r.last {
+		return ipRange{}, fmt.Errorf("Invalid range '%s'", s)
+	}
+	return r, nil
+}
+
+// parsePoolFlag parses a pool given on the command line, e.g.
+// name=backoffice,vlanid=3134,subnet=10.0.0.0/24,gateway=10.0.0.1,range=10.0.0.100-10.0.0.200,exclude=10.0.0.150
+func parsePoolFlag(s string) (*Pool, error) {
+	p := &Pool{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid pool option '%s'", kv)
+		}
+		switch parts[0] {
+		case "name":
+			p.Name = parts[1]
+		case "vlanid":
+			p.VlanID = parts[1]
+		case "subnet":
+			p.Subnet = parts[1]
+		case "gateway":
+			p.Gateway = parts[1]
+		case "range":
+			p.Range = parts[1]
+		case "exclude":
+			p.Exclude = append(p.Exclude, parts[1])
+		default:
+			return nil, fmt.Errorf("Unknown pool option '%s'", parts[0])
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// validate checks the pool definition and computes the allocatable range
+func (p *Pool) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("Pool requires a name")
+	}
+	ip, network, err := net.ParseCIDR(p.Subnet)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("Pool '%s' has invalid IPv4 subnet '%s'", p.Name, p.Subnet)
+	}
+	p.network = network
+	ones, _ := network.Mask.Size()
+	base := ipToUint(network.IP)
+	size := uint32(1) << uint(32-ones)
+	p.first, p.last = base, base+size-1
+	if size > 2 {
+		// Skip the network and broadcast addresses
+		p.first, p.last = base+1, base+size-2
+	}
+	if p.Range != "" {
+		r, err := parseIPRange(p.Range)
+		if err != nil {
+			return fmt.Errorf("Pool '%s': %s", p.Name, err.Error())
+		}
+		if !network.Contains(uintToIP(r.first)) || !network.Contains(uintToIP(r.last)) {
+			return fmt.Errorf("Pool '%s' range '%s' is outside subnet '%s'", p.Name, p.Range, p.Subnet)
+		}
+		p.first, p.last = r.first, r.last
+	}
+	if p.Gateway != "" {
+		if p.gateway, err = parseIPv4(p.Gateway); err != nil {
+			return fmt.Errorf("Pool '%s': %s", p.Name, err.Error())
+		}
+		if !network.Contains(p.gateway) {
+			return fmt.Errorf("Pool '%s' gateway '%s' is outside subnet '%s'", p.Name, p.Gateway, p.Subnet)
+		}
+	}
+	p.excluded = nil
+	for _, e := range p.Exclude {
+		r, err := parseIPRange(e)
+		if err != nil {
+			return fmt.Errorf("Pool '%s': %s", p.Name, err.Error())
+		}
+		p.excluded = append(p.excluded, r)
+	}
+	return nil
+}
+
+// allocatable reports whether ip may be handed out from the pool
+func (p *Pool) allocatable(ip net.IP) bool {
+	if ip.To4() == nil || !p.network.Contains(ip) {
+		return false
+	}
+	if p.gateway != nil && p.gateway.Equal(ip) {
+		return false
+	}
+	n := ipToUint(ip)
+	if n < p.first || n > p.last {
+		return false
+	}
+	for _, r := range p.excluded {
+		if n >= r.first && n <= r.last {
+			return false
+		}
+	}
+	return true
+}
+
+// CIDR returns ip with the prefix length of the pool subnet
+func (p *Pool) CIDR(ip net.IP) string {
+	ones, _ := p.network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func poolMap(pools []*Pool) (map[string]*Pool, error) {
+	m := make(map[string]*Pool)
+	for _, p := range pools {
+		if _, ok := m[p.Name]; ok {
+			return nil, fmt.Errorf("Duplicate pool '%s'", p.Name)
+		}
+		m[p.Name] = p
+	}
+	return m, nil
+}
+
+func NewAddressManager(stateDir string, pools []*Pool) (*AddressManager, error) {
+	m, err := poolMap(pools)
+	if err != nil {
+		return nil, err
+	}
+	am := &AddressManager{
+		path:  filepath.Join(stateDir, "leases.json"),
+		pools: m,
+	}
+	if err := readJSONFile(am.path, &am.leases); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// SetPools replaces the pools. Leases in pools that no longer exist are kept
+// until their owners release them.
+func (am *AddressManager) SetPools(pools []*Pool) error {
+	m, err := poolMap(pools)
+	if err != nil {
+		return err
+	}
+	am.Lock()
+	defer am.Unlock()
+	am.pools = m
+	return nil
+}
+
+func (am *AddressManager) Pool(name string) (*Pool, bool) {
+	am.Lock()
+	defer am.Unlock()
+	p, ok := am.pools[name]
+	return p, ok
+}
+
+// FindPool returns the pool for a VLAN or subnet
+func (am *AddressManager) FindPool(vlanID string, subnet string) (*Pool, bool) {
+	am.Lock()
+	defer am.Unlock()
+	names := make([]string, 0, len(am.pools))
+	for name := range am.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := am.pools[name]
+		if (vlanID != "" && p.VlanID == vlanID) || (subnet != "" && p.network.String() == subnet) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// withLeases reads the leases while holding the lock on the leases file, runs
+// fn and saves the leases when fn returns true. The caller holds am's lock.
+func (am *AddressManager) withLeases(fn func() (bool, error)) error {
+	lock, err := lockFile(am.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	var leases []Lease
+	if err := readJSONFile(am.path, &leases); err != nil {
+		return err
+	}
+	am.leases = leases
+	save, err := fn()
+	if err != nil || !save {
+		return err
+	}
+	return writeJSONFile(am.path, am.leases)
+}
+
+func (am *AddressManager) Leases() ([]Lease, error) {
+	am.Lock()
+	defer am.Unlock()
+	var leases []Lease
+	err := am.withLeases(func() (bool, error) {
+		leases = append([]Lease{}, am.leases...)
+		return false, nil
+	})
+	return leases, err
+}
+
+func (am *AddressManager) leased(pool string, ip net.IP) *Lease {
+	for i, l := range am.leases {
+		if l.Pool == pool && net.ParseIP(l.Address).Equal(ip) {
+			return &am.leases[i]
+		}
+	}
+	return nil
+}
+
+// Allocate leases an address from pool to owner. An owner other than 'docker'
+// that already holds a lease gets the same address back. When requested is set
+// only that address is leased.
+func (am *AddressManager) Allocate(pool string, owner string, requested string) (net.IP, error) {
+	am.Lock()
+	defer am.Unlock()
+	p, ok := am.pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("No such pool: %s", pool)
+	}
+	var ip net.IP
+	err := am.withLeases(func() (bool, error) {
+		var err error
+		if ip, err = am.lookup(p, owner, requested); err != nil {
+			return false, err
+		}
+		if am.leased(pool, ip) != nil {
+			return false, nil
+		}
+		am.leases = append(am.leases, Lease{Pool: pool, Address: ip.String(), Owner: owner, UpdatedAt: time.Now()})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// Peek returns the address Allocate would lease without leasing it
+func (am *AddressManager) Peek(pool string, owner string, requested string) (net.IP, error) {
+	am.Lock()
+	defer am.Unlock()
+	p, ok := am.pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("No such pool: %s", pool)
+	}
+	var ip net.IP
+	err := am.withLeases(func() (bool, error) {
+		var err error
+		ip, err = am.lookup(p, owner, requested)
+		return false, err
+	})
+	return ip, err
+}
+
+// lookup picks the address owner gets from p; the caller holds the lock
+func (am *AddressManager) lookup(p *Pool, owner string, requested string) (net.IP, error) {
+	pool := p.Name
+	if requested == "" && owner != "docker" {
+		for _, l := range am.leases {
+			if l.Pool == pool && l.Owner == owner {
+				return net.ParseIP(l.Address).To4(), nil
+			}
+		}
+	}
+
+	var ip net.IP
+	if requested != "" {
+		r, err := parseIPv4(strings.Split(requested, "/")[0])
+		if err != nil {
+			return nil, err
+		}
+		if !p.allocatable(r) {
+			return nil, fmt.Errorf("Address '%s' is not available in pool '%s'", requested, pool)
+		}
+		// Docker leases share one owner, so only containers may request their own lease again
+		if l := am.leased(pool, r); l != nil && (l.Owner != owner || owner == "docker") {
+			return nil, fmt.Errorf("Address '%s' is already leased to '%s'", requested, l.Owner)
+		}
+		ip = r
+	} else {
+		for n := p.first; n <= p.last && n >= p.first; n++ {
+			candidate := uintToIP(n)
+			if p.allocatable(candidate) && am.leased(pool, candidate) == nil {
+				ip = candidate
+				break
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("Pool '%s' is exhausted", pool)
+		}
+	}
+	return ip, nil
+}
+
+// Release removes the leases in pool matching the address or owner
+func (am *AddressManager) Release(pool string, address string, owner string) error {
+	ip := net.ParseIP(strings.Split(address, "/")[0])
+	_, err := am.releaseWhere(func(l Lease) bool {
+		return l.Pool == pool && ((ip != nil && net.ParseIP(l.Address).Equal(ip)) || (owner != "" && l.Owner == owner))
+	})
+	return err
+}
+
+// ReleaseOwner removes all leases held by owner and returns them
+func (am *AddressManager) ReleaseOwner(owner string) ([]Lease, error) {
+	return am.releaseWhere(func(l Lease) bool { return l.Owner == owner })
+}
+
+// ReleaseContainer removes the leases of all links of a container, those held
+// by its name and by 'name:ifname', and returns them
+func (am *AddressManager) ReleaseContainer(name string) ([]Lease, error) {
+	return am.releaseWhere(func(l Lease) bool {
+		return l.Owner == name || strings.HasPrefix(l.Owner, name+":")
+	})
+}
+
+func (am *AddressManager) releaseWhere(match func(l Lease) bool) ([]Lease, error) {
+	am.Lock()
+	defer am.Unlock()
+	var released []Lease
+	err := am.withLeases(func() (bool, error) {
+		kept := am.leases[:0:0]
+		for _, l := range am.leases {
+			if match(l) {
+				released = append(released, l)
+				continue
+			}
+			kept = append(kept, l)
+		}
+		am.leases = kept
+		return len(released) > 0, nil
+	})
+	return released, err
+}
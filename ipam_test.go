@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePoolFlag(t *testing.T) {
+	for _, tt := range []struct {
+		flag  string
+		valid bool
+	}{
+		{"name=backoffice,vlanid=3134,subnet=10.0.0.0/24,gateway=10.0.0.1,range=10.0.0.100-10.0.0.200,exclude=10.0.0.150", true},
+		{"name=p2p,subnet=10.0.0.0/31", true},
+		{"name=backoffice,subnet=10.0.0.0/24,exclude=10.0.0.10-10.0.0.19,exclude=10.0.0.30", true},
+		{"subnet=10.0.0.0/24", false},
+		{"name=backoffice", false},
+		{"name=backoffice,subnet=fd00::/64", false},
+		{"name=backoffice,subnet=10.0.0.0/24,gateway=10.0.1.1", false},
+		{"name=backoffice,subnet=10.0.0.0/24,range=10.0.0.200-10.0.0.100", false},
+		{"name=backoffice,subnet=10.0.0.0/24,range=10.0.0.100-10.0.1.100", false},
+		{"name=backoffice,subnet=10.0.0.0/24,exclude=10.0.0", false},
+		{"name=backoffice,subnet=10.0.0.0/24,size=10", false},
+		{"name=backoffice,subnet", false},
+	} {
+		if _, err := parsePoolFlag(tt.flag); (err == nil) != tt.valid {
+			t.Errorf("parsePoolFlag(%s) returned %v, want valid %v", tt.flag, err, tt.valid)
+		}
+	}
+}
+
+func testAddressManager(t *testing.T, flags ...string) (*AddressManager, func()) {
+	dir, err := ioutil.TempDir("", "plumber-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pools []*Pool
+	for _, flag := range flags {
+		p, err := parsePoolFlag(flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools = append(pools, p)
+	}
+	am, err := NewAddressManager(dir, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return am, func() { os.RemoveAll(dir) }
+}
+
+func TestAllocate(t *testing.T) {
+	am, cleanup := testAddressManager(t, "name=small,subnet=10.0.0.0/29,gateway=10.0.0.1,exclude=10.0.0.3-10.0.0.4")
+	defer cleanup()
+
+	// Allocatable are .2, .5 and .6: not the network, gateway, excluded or broadcast addresses
+	for _, tt := range []struct {
+		owner, requested string
+		want             string
+	}{
+		{"web", "", "10.0.0.2"},
+		{"web", "", "10.0.0.2"},
+		{"db", "10.0.0.6/29", "10.0.0.6"},
+		{"docker", "", "10.0.0.5"},
+		{"docker", "10.0.0.5", ""},
+		{"docker", "", ""},
+		{"cache", "", ""},
+		{"cache", "10.0.0.3", ""},
+		{"cache", "10.0.0.1", ""},
+		{"cache", "10.0.0.6", ""},
+		{"cache", "10.0.1.2", ""},
+		{"db", "10.0.0.6", "10.0.0.6"},
+	} {
+		ip, err := am.Allocate("small", tt.owner, tt.requested)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("Allocate(%s, %s) = %s, want an error", tt.owner, tt.requested, ip)
+		case tt.want != "" && err != nil:
+			t.Errorf("Allocate(%s, %s) failed: %s", tt.owner, tt.requested, err)
+		case tt.want != "" && ip.String() != tt.want:
+			t.Errorf("Allocate(%s, %s) = %s, want %s", tt.owner, tt.requested, ip, tt.want)
+		}
+	}
+	if _, err := am.Allocate("missing", "web", ""); err == nil {
+		t.Error("Allocating from a missing pool succeeded")
+	}
+
+	leases, err := am.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 3 {
+		t.Errorf("Got %d leases, want 3: %v", len(leases), leases)
+	}
+
+	// A released address is handed out again
+	if err := am.Release("small", "10.0.0.5", ""); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := am.Peek("small", "cache", ""); err != nil || ip.String() != "10.0.0.5" {
+		t.Errorf("Peek after release = %s, %v, want 10.0.0.5", ip, err)
+	}
+	if ip, err := am.Allocate("small", "cache", ""); err != nil || ip.String() != "10.0.0.5" {
+		t.Errorf("Allocate after release = %s, %v, want 10.0.0.5", ip, err)
+	}
+}
+
+func TestReleaseContainer(t *testing.T) {
+	am, cleanup := testAddressManager(t, "name=backoffice,subnet=10.0.0.0/24", "name=frontoffice,subnet=10.0.1.0/24")
+	defer cleanup()
+	for _, l := range []struct{ pool, owner string }{
+		{"backoffice", "web"},
+		{"frontoffice", "web:eth1"},
+		{"frontoffice", "web:eth2"},
+		{"backoffice", "web2"},
+		{"backoffice", "db:eth1"},
+		{"backoffice", "docker"},
+	} {
+		if _, err := am.Allocate(l.pool, l.owner, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		release  func() ([]Lease, error)
+		released []string
+		kept     int
+	}{
+		// Attachments lease under 'name:ifname', so releasing the owner leaves them
+		{func() ([]Lease, error) { return am.ReleaseOwner("db") }, nil, 6},
+		{func() ([]Lease, error) { return am.ReleaseContainer("web") }, []string{"web", "web:eth1", "web:eth2"}, 3},
+		{func() ([]Lease, error) { return am.ReleaseContainer("web") }, nil, 3},
+		{func() ([]Lease, error) { return am.ReleaseOwner("db:eth1") }, []string{"db:eth1"}, 2},
+		{func() ([]Lease, error) { return am.ReleaseContainer("web2") }, []string{"web2"}, 1},
+	} {
+		released, err := tt.release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var owners []string
+		for _, l := range released {
+			owners = append(owners, l.Owner)
+		}
+		if !reflect.DeepEqual(owners, tt.released) {
+			t.Errorf("Released %v, want %v", owners, tt.released)
+		}
+		if leases, _ := am.Leases(); len(leases) != tt.kept {
+			t.Errorf("Kept %d leases, want %d: %v", len(leases), tt.kept, leases)
+		}
+	}
+}
+
+func TestAllocateSharedLeases(t *testing.T) {
+	am, cleanup := testAddressManager(t, "name=backoffice,subnet=10.0.0.0/24")
+	defer cleanup()
+	// Another process with the same state directory, like the attach subcommand
+	other, err := NewAddressManager(filepath.Dir(am.path), []*Pool{am.pools["backoffice"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := am.Allocate("backoffice", "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := other.Allocate("backoffice", "db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Equal(second) {
+		t.Errorf("Both address managers leased %s", first)
+	}
+}
+
+func TestAllocateDuplicateDockerAddress(t *testing.T) {
+	am, cleanup := testAddressManager(t, "name=backoffice,subnet=10.0.0.0/24")
+	defer cleanup()
+
+	// Two docker endpoints requesting the same --ip must not share it
+	if ip, err := am.Allocate("backoffice", "docker", "10.0.0.50"); err != nil || ip.String() != "10.0.0.50" {
+		t.Fatalf("First request = %s, %v, want 10.0.0.50", ip, err)
+	}
+	if ip, err := am.Allocate("backoffice", "docker", "10.0.0.50"); err == nil {
+		t.Errorf("Second request = %s, want an error", ip)
+	}
+	if err := am.Release("backoffice", "10.0.0.50", ""); err != nil {
+		t.Fatal(err)
+	}
+	if leases, _ := am.Leases(); len(leases) != 0 {
+		t.Errorf("Kept %d leases after the release, want 0: %v", len(leases), leases)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Options docker sets when it asks the IPAM driver for an address
+const (
+	requestAddressTypeKey = "RequestAddressType"
+	gatewayAddressType    = "com.docker.network.gateway"
+)
+
+type requestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type requestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type releasePoolRequest struct {
+	PoolID string
+}
+
+type requestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type requestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type releaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+// IPAMDriver implements the libnetwork remote IPAM driver protocol on top of
+// plumber's address pools. It uses the address manager of the moment, so
+// pools added by a reload are available right away.
+type IPAMDriver struct{}
+
+// manager returns the current address manager or writes why there is none
+func (id *IPAMDriver) manager(w http.ResponseWriter) (*AddressManager, bool) {
+	am := currentIPAM()
+	if am == nil {
+		writePluginError(w, fmt.Errorf("No address pools configured"))
+		return nil, false
+	}
+	return am, true
+}
+
+func (id *IPAMDriver) register(r *mux.Router) {
+	r.HandleFunc("/IpamDriver.GetCapabilities", id.getCapabilities).Methods("POST")
+	r.HandleFunc("/IpamDriver.GetDefaultAddressSpaces", id.getDefaultAddressSpaces).Methods("POST")
+	r.HandleFunc("/IpamDriver.RequestPool", id.requestPool).Methods("POST")
+	r.HandleFunc("/IpamDriver.ReleasePool", id.releasePool).Methods("POST")
+	r.HandleFunc("/IpamDriver.RequestAddress", id.requestAddress).Methods("POST")
+	r.HandleFunc("/IpamDriver.ReleaseAddress", id.releaseAddress).Methods("POST")
+}
+
+func (id *IPAMDriver) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, map[string]bool{"RequiresMACAddress": false})
+}
+
+func (id *IPAMDriver) getDefaultAddressSpaces(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, map[string]string{
+		"LocalDefaultAddressSpace":  "plumber",
+		"GlobalDefaultAddressSpace": "plumber",
+	})
+}
+
+// requestPool selects a configured pool by the 'pool' or 'vlanid' ipam option,
+// or by the subnet given to 'docker network create'
+func (id *IPAMDriver) requestPool(w http.ResponseWriter, r *http.Request) {
+	var req requestPoolRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	if req.V6 {
+		writePluginError(w, fmt.Errorf("IPv6 pools are not supported"))
+		return
+	}
+	am, ok := id.manager(w)
+	if !ok {
+		return
+	}
+	var p *Pool
+	if name := req.Options["pool"]; name != "" {
+		p, ok = am.Pool(name)
+	} else {
+		p, ok = am.FindPool(req.Options["vlanid"], req.Pool)
+	}
+	if !ok {
+		writePluginError(w, fmt.Errorf("No pool configured for options %v and subnet '%s'", req.Options, req.Pool))
+		return
+	}
+	if req.Pool != "" && req.Pool != p.network.String() {
+		writePluginError(w, fmt.Errorf("Subnet '%s' does not match pool '%s' subnet '%s'", req.Pool, p.Name, p.Subnet))
+		return
+	}
+	resp := requestPoolResponse{
+		PoolID: p.Name,
+		Pool:   p.network.String(),
+		Data:   map[string]string{},
+	}
+	if p.gateway != nil {
+		resp.Data[gatewayAddressType] = p.CIDR(p.gateway)
+	}
+	Logger.Printf("IPAM: handing out pool '%s' (%s)", p.Name, p.Subnet)
+	writePluginResponse(w, resp)
+}
+
+func (id *IPAMDriver) releasePool(w http.ResponseWriter, r *http.Request) {
+	var req releasePoolRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	writePluginResponse(w, struct{}{})
+}
+
+func (id *IPAMDriver) requestAddress(w http.ResponseWriter, r *http.Request) {
+	var req requestAddressRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	am, ok := id.manager(w)
+	if !ok {
+		return
+	}
+	p, ok := am.Pool(req.PoolID)
+	if !ok {
+		writePluginError(w, fmt.Errorf("No such pool: %s", req.PoolID))
+		return
+	}
+	// The gateway is part of the pool definition and never leased
+	if req.Options[requestAddressTypeKey] == gatewayAddressType {
+		if p.gateway == nil {
+			writePluginError(w, fmt.Errorf("Pool '%s' has no gateway", p.Name))
+			return
+		}
+		if req.Address != "" && !p.gateway.Equal(parseIPOrNil(req.Address)) {
+			writePluginError(w, fmt.Errorf("Gateway '%s' does not match pool '%s' gateway '%s'", req.Address, p.Name, p.Gateway))
+			return
+		}
+		writePluginResponse(w, requestAddressResponse{Address: p.CIDR(p.gateway)})
+		return
+	}
+	ip, err := am.Allocate(p.Name, "docker", req.Address)
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+	Logger.Printf("IPAM: leased '%s' from pool '%s'", ip, p.Name)
+	writePluginResponse(w, requestAddressResponse{Address: p.CIDR(ip)})
+}
+
+func (id *IPAMDriver) releaseAddress(w http.ResponseWriter, r *http.Request) {
+	var req releaseAddressRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	am, ok := id.manager(w)
+	if !ok {
+		return
+	}
+	p, ok := am.Pool(req.PoolID)
+	if !ok {
+		writePluginError(w, fmt.Errorf("No such pool: %s", req.PoolID))
+		return
+	}
+	if p.gateway != nil && p.gateway.Equal(parseIPOrNil(req.Address)) {
+		writePluginResponse(w, struct{}{})
+		return
+	}
+	if err := am.Release(p.Name, req.Address, ""); err != nil {
+		writePluginError(w, err)
+		return
+	}
+	Logger.Printf("IPAM: released '%s' to pool '%s'", req.Address, p.Name)
+	writePluginResponse(w, struct{}{})
+}
+
+// parseIPOrNil parses an address with or without prefix length
+func parseIPOrNil(s string) net.IP {
+	return net.ParseIP(strings.Split(s, "/")[0])
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/milosgajdos83/tenus"
-	"github.com/docker/libcontainer/netlink"
 	"github.com/docker/docker/pkg/reexec"
+	"github.com/docker/libcontainer/netlink"
+	"github.com/milosgajdos83/tenus"
 	"github.com/vishvananda/netns"
-	"runtime"
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 )
 
 type VlanLink struct {
@@ -22,6 +27,7 @@ type MacvlanLink struct {
 	name    string
 	options tenus.MacVlanOptions
 	link    tenus.Linker
+	result  linkResult
 }
 
 func getVlanLink(linkName string, linkOptions tenus.VlanOptions) (*VlanLink, error) {
@@ -57,13 +63,25 @@ func (c *Container) setupHostLink(linkName string, linkOptions tenus.VlanOptions
 	// Create VLAN parent interface
 	l, err := tenus.NewVlanLinkWithOptions(linkName, linkOptions)
 	if err != nil {
-		c.Logger.Error(err.Error())
+		return nil, err
 	}
 	c.Logger.Debugf("VLAN link: %s", l)
+	e := AuditEntry{
+		Event:   "parent.create",
+		Parent:  linkName,
+		VlanID:  fmt.Sprint(linkOptions.Id),
+		Link:    linkOptions.Dev,
+		MacAddr: linkOptions.MacAddr,
+	}
 	//Bring interface online
 	if err = l.SetLinkUp(); err != nil {
+		// An existing parent is used as it is, so do not leave one that is down
+		l.DeleteLink()
+		e.Outcome, e.Reason = "failed", err.Error()
+		c.audit(e)
 		return nil, err
 	}
+	c.audit(e)
 
 	c.Logger.Debugf("Brought VLAN link online: %s", l)
 
@@ -76,25 +94,157 @@ func (c *Container) setupHostLink(linkName string, linkOptions tenus.VlanOptions
 
 func init() {
 	reexec.Register("setup-container-link", reexecSetupContainerLink)
+	reexec.Register("teardown-container-link", reexecTeardownContainerLink)
+	reexec.Register("shape-container-link", reexecShapeContainerLink)
 	if reexec.Init() {
 		os.Exit(0)
 	}
 }
 
-func reexecSetupContainerLink() {
-	containerName := os.Args[1]
-	containerID := os.Args[2]
-	parentLink := os.Args[3]
-	dockerHost := os.Args[4]
-	linkOptions := &tenus.MacVlanOptions{
-		Mode:    "bridge",
-		MacAddr: os.Args[5],
-		Dev:     os.Args[6],
+// configureAddress assigns addr, in CIDR notation, to the named link and adds
+// a default route via gateway when one is given. Existing addresses and
+// routes are left alone.
+func configureAddress(ifName string, addr string, gateway string) error {
+	ifc, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	ip, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid address '%s': %s", addr, err.Error())
+	}
+	if !hasAddress(ifc, ip) {
+		if err := netlink.NetworkLinkAddIp(ifc, ip, ipNet); err != nil {
+			return fmt.Errorf("Error adding address '%s': %s", addr, err.Error())
+		}
+		recordLinkChange("address.add", ifName, addr)
+	}
+	if gateway != "" {
+		err := netlink.AddDefaultGw(gateway, ifName)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Error adding default gateway '%s': %s", gateway, err.Error())
+		}
+		if err == nil {
+			recordLinkChange("route.add", ifName, "default via "+gateway)
+		}
+	}
+	return nil
+}
+
+func hasAddress(ifc *net.Interface, ip net.IP) bool {
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
 	}
+	return false
+}
+
+// linkResult is reported by the setup-container-link reexec command to its parent.
+type linkResult struct {
+	MacAddr             string `json:"macAddress,omitempty"`
+	Error               string `json:"error,omitempty"`
+	Class               string `json:"class,omitempty"`
+	NetworkStatus       string `json:"networkStatus,omitempty"`
+	NetworkStatusDetail string `json:"networkStatusDetail,omitempty"`
+	Pid                 int    `json:"pid,omitempty"`
+	// Changes are what the command changed, also when it failed
+	Changes []LinkChange `json:"changes,omitempty"`
+}
 
+// writeLinkResult reports the result on the pipe passed as the first extra file.
+func writeLinkResult(r linkResult) {
+	f := os.NewFile(3, "result")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(r)
+}
+
+// linkSpec describes the container link the setup-container-link reexec
+// command creates. It is passed as a JSON argument.
+type linkSpec struct {
+	ContainerName string                 `json:"containerName"`
+	ContainerID   string                 `json:"containerId"`
+	ParentLink    string                 `json:"parentLink"`
+	DockerHost    string                 `json:"dockerHost"`
+	MacAddr       string                 `json:"macAddress"`
+	Dev           string                 `json:"dev"`
+	Network       ContainerNetworkConfig `json:"network"`
+	// Previous is the configuration a shape-container-link command replaces
+	Previous     *ContainerNetworkConfig `json:"previous,omitempty"`
+	DADProbes    int                     `json:"dadProbes"`
+	DADInterval  time.Duration           `json:"dadInterval"`
+	GARPCount    int                     `json:"garpCount"`
+	GARPInterval time.Duration           `json:"garpInterval"`
+	Verify       bool                    `json:"verify"`
+	ProbeTimeout time.Duration           `json:"probeTimeout"`
+}
+
+func reexecSetupContainerLink() {
 	initializeLogger()
-	c:= NewContainer(containerID)
 
+	var spec linkSpec
+	if len(os.Args) < 2 {
+		Logger.Fatal("Missing container link specification")
+	}
+	if err := json.Unmarshal([]byte(os.Args[1]), &spec); err != nil {
+		Logger.Fatalf("Invalid container link specification: %s", err.Error())
+	}
+	c := NewContainer(spec.ContainerID)
+
+	result, err := c.setupContainerLinkInNamespace(&spec)
+	if err != nil {
+		c.Logger.Error(err.Error())
+		writeLinkResult(linkResult{Error: err.Error(), Class: errorClass(err), Changes: linkChanges})
+		os.Exit(1)
+	}
+	result.Changes = linkChanges
+	writeLinkResult(*result)
+	os.Exit(0)
+}
+
+// detectDuplicateAddress refuses an IPv4 address another host on the link
+// already answers for. The calling thread is in the container namespace.
+func (c *Container) detectDuplicateAddress(ifc *net.Interface, spec *linkSpec) error {
+	ip, _, err := net.ParseCIDR(spec.Network.IPAddress)
+	if err != nil {
+		return &setupError{"config", fmt.Errorf("Invalid address '%s': %s", spec.Network.IPAddress, err.Error())}
+	}
+	if spec.DADProbes <= 0 || ip.To4() == nil || hasAddress(ifc, ip) {
+		return nil
+	}
+	c.Logger.Debugf("Probing for address '%s' on '%s'", ip, ifc.Name)
+	mac, err := probeAddress(ifc, ip, spec.DADProbes, spec.DADInterval)
+	if err != nil {
+		return err
+	}
+	if mac != nil {
+		return &setupError{"conflict", fmt.Errorf("Address conflict: '%s' is already in use by %s", ip, mac)}
+	}
+	return nil
+}
+
+// containerNetns returns the network namespace of a running container, looked
+// up by name or ID, and the PID it was found through
+func containerNetns(container string, dockerHost string) (netns.NsHandle, int, error) {
+	pid, err := tenus.DockerPidByName(container, getDockerHostPath(dockerHost))
+	if err != nil {
+		return netns.None(), 0, fmt.Errorf("Error getting container PID: %s", err.Error())
+	}
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return netns.None(), 0, fmt.Errorf("Error getting container namespace: %s", err.Error())
+	}
+	return ns, pid, nil
+}
+
+func (c *Container) setupContainerLinkInNamespace(spec *linkSpec) (*linkResult, error) {
 	// Lock OS thread to avoid switching namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -102,109 +252,408 @@ func reexecSetupContainerLink() {
 	// Save current NS
 	origns, err := netns.Get()
 	if err != nil {
-		c.Logger.Fatalf("Error saving current NS: %s", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error saving current NS: %s", err.Error())
 	}
 	defer origns.Close()
+	// Always switch back to the original namespace
+	defer netns.Set(origns)
 
-	//Get container PID
-	pid, err := tenus.DockerPidByName(containerName, getDockerHostPath(dockerHost))
+	// Check the probe target before anything is configured
+	probeTarget, err := probeTargetFor(&spec.Network, spec.Verify)
 	if err != nil {
-		c.Logger.Fatalf("Error getting container PID: %s", err.Error())
-		os.Exit(1)
+		return nil, &setupError{"config", err}
+	}
+
+	ns, pid, err := containerNetns(spec.ContainerName, spec.DockerHost)
+	if err != nil {
+		return nil, err
 	}
+	defer ns.Close()
 	c.Logger.Debugf("Container PID is: %v", pid)
 
-	cIfNameTemp := fmt.Sprintf("mcv%v", pid)
+	ifc, err := c.setupLinkInNamespace(origns, ns, spec.ParentLink, fmt.Sprintf("mcv%v", pid), &tenus.MacVlanOptions{
+		Dev:     spec.Dev,
+		MacAddr: spec.MacAddr,
+		Mode:    "bridge",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Network.MTU > 0 && ifc.MTU != spec.Network.MTU {
+		if err := netlink.NetworkSetMTU(ifc, spec.Network.MTU); err != nil {
+			return nil, fmt.Errorf("Error setting MTU of '%s' to %d: %s", ifc.Name, spec.Network.MTU, err.Error())
+		}
+		ifc.MTU = spec.Network.MTU
+		recordLinkChange("link.mtu", ifc.Name, fmt.Sprint(spec.Network.MTU))
+	}
+
+	// Filter before the address is configured so the container is never exposed
+	if spec.Network.Firewall != "" {
+		fw, err := parseFirewall(spec.Network.Firewall)
+		if err != nil {
+			return nil, &setupError{"config", err}
+		}
+		if err := applyFirewall(fw, spec.Dev); err != nil {
+			return nil, &setupError{"firewall", err}
+		}
+		c.Logger.Debugf("Loaded firewall rules: %s", spec.Network.Firewall)
+		recordLinkChange("firewall.load", spec.Dev, spec.Network.Firewall)
+	}
+
+	if err := applySysctls(spec.Network.Sysctls); err != nil {
+		return nil, &setupError{"sysctl", err}
+	}
+	if len(spec.Network.Sysctls) > 0 {
+		settings := make([]string, 0, len(spec.Network.Sysctls))
+		for key, value := range spec.Network.Sysctls {
+			settings = append(settings, key+"="+value)
+		}
+		sort.Strings(settings)
+		recordLinkChange("sysctl.set", spec.Dev, strings.Join(settings, " "))
+	}
+
+	// A new link has no qdiscs to remove, an existing one has those of spec.Network
+	if err := applyShaping(spec.Dev, &spec.Network, nil); err != nil {
+		return nil, &setupError{"shaping", err}
+	}
+	if spec.Network.EgressRate != "" || spec.Network.IngressRate != "" || spec.Network.Netem != nil {
+		recordLinkChange("shaping.set", spec.Dev, fmt.Sprintf("egress '%s', ingress '%s', netem %v", spec.Network.EgressRate, spec.Network.IngressRate, spec.Network.Netem != nil))
+	}
+
+	// Mirror before the address is configured so the IDS sees all traffic
+	if spec.Network.Mirror != "" {
+		if err := c.setupMirrorInNamespace(origns, ns, spec.Dev, ifc.HardwareAddr.String(), spec.Network.Mirror); err != nil {
+			return nil, &setupError{"mirror", err}
+		}
+	}
+
+	if spec.Network.IPAddress != "" {
+		if err := c.detectDuplicateAddress(ifc, spec); err != nil {
+			return nil, err
+		}
+		if err := configureAddress(spec.Dev, spec.Network.IPAddress, spec.Network.Gateway); err != nil {
+			return nil, err
+		}
+		c.Logger.Debugf("Assigned address '%s' to '%s'", spec.Network.IPAddress, spec.Dev)
+
+		// The MAC is new on every setup, so tell neighbors about it
+		if spec.GARPCount > 0 {
+			if err := announceAddresses(ifc, spec.GARPCount, spec.GARPInterval); err != nil {
+				c.Logger.Warnf("Failed announcing addresses: %s", err.Error())
+			} else {
+				c.Logger.Debugf("Announced addresses on '%s'", spec.Dev)
+			}
+		}
+	}
+	result := &linkResult{MacAddr: ifc.HardwareAddr.String(), Pid: pid}
+
+	// Verify the link actually reaches the network, e.g. that the VLAN is trunked to the host.
+	// The link is configured by now, so a failing probe only leaves the status unknown.
+	if probeTarget != nil {
+		status, detail, err := probeConnectivity(ifc, probeTarget, spec.ProbeTimeout)
+		if err != nil {
+			status, detail = NetworkUnknown, fmt.Sprintf("Error probing connectivity: %s", err.Error())
+		}
+		result.NetworkStatus, result.NetworkStatusDetail = status, detail
+		if status == NetworkReachable {
+			c.Logger.Printf("Network %s: %s", status, detail)
+		} else {
+			c.Logger.Warnf("Network %s: %s", status, detail)
+		}
+	}
+	return result, nil
+}
+
+// setupLinkInNamespace creates a macvlan link on parentLink in the original
+// namespace and moves it into ns, named linkOptions.Dev. An existing link with
+// that name is left alone. The calling goroutine must be locked to its thread
+// and is left in ns.
+func (c *Container) setupLinkInNamespace(origns, ns netns.NsHandle, parentLink, tempName string, linkOptions *tenus.MacVlanOptions) (*net.Interface, error) {
 	cIfName := linkOptions.Dev
 
 	//Enter container namespace and check if link exists
-	if err = tenus.SetNetNsToPid(pid); err != nil {
-		c.Logger.Fatalf("Error entering container namespace: %s", err.Error())
-		os.Exit(1)
-	}
-	ns, err := netns.Get()
-	if err != nil {
-		c.Logger.Fatalf("Error getting container namespace: %s", err.Error())
-		os.Exit(1)
+	if err := netns.Set(ns); err != nil {
+		return nil, fmt.Errorf("Error entering container namespace: %s", err.Error())
 	}
 	c.Logger.Debugf("Entered container network namespace: %v", ns)
 
-	if _, err := net.InterfaceByName(cIfName); err == nil {
-		// Switch back to the original namespace
-		netns.Set(origns)
-
+	if ifc, err := net.InterfaceByName(cIfName); err == nil {
 		c.Logger.Warnf("Container link '%s' already exists. Skipping setup.", cIfName)
-		os.Exit(0)
+		return ifc, nil
 	}
 
 	// Switch back to the original namespace
 	netns.Set(origns)
 
 	l, err := tenus.NewMacVlanLinkWithOptions(parentLink, tenus.MacVlanOptions{
-		Dev:     cIfNameTemp,
+		Dev:     tempName,
 		MacAddr: linkOptions.MacAddr,
 		Mode:    linkOptions.Mode,
 	})
 	if err != nil {
-		c.Logger.Fatalf("Error creating macvlan link: %s", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error creating macvlan link: %s", err.Error())
 	}
 	c.Logger.Debugf("MACVLAN link: %s", l)
+	recordLinkChange("link.create", tempName, fmt.Sprintf("macvlan on '%s'", parentLink))
 
 	//Move link into container namespace
-	if err := l.SetLinkNetNsPid(pid); err != nil {
-		c.Logger.Fatalf("Error moving link to container namespace: %s", err.Error())
-		os.Exit(1)
+	if err := netlink.NetworkSetNsFd(l.NetInterface(), int(ns)); err != nil {
+		l.DeleteLink()
+		recordLinkChange("link.delete", tempName, "moving to the container namespace failed")
+		return nil, fmt.Errorf("Error moving link to container namespace: %s", err.Error())
 	}
-	c.Logger.Debugf("Moved link '%s' to container", cIfNameTemp)
+	c.Logger.Debugf("Moved link '%s' to container", tempName)
+	recordLinkChange("link.move", tempName, "to the container namespace")
 
 	//Enter container namespace and rename link
-	if err = tenus.SetNetNsToPid(pid); err != nil {
-		c.Logger.Fatalf("Error entering container namespace: %s", err.Error())
-		os.Exit(1)
-	}
-	ns, err = netns.Get()
-	if err != nil {
-		c.Logger.Fatalf("Error getting container namespace: %s", err.Error())
-		os.Exit(1)
+	if err = netns.Set(ns); err != nil {
+		return nil, fmt.Errorf("Error entering container namespace: %s", err.Error())
 	}
 	c.Logger.Debugf("Entered container network namespace: %v", ns)
 	if err = netlink.NetworkChangeName(l.NetInterface(), cIfName); err != nil {
-		c.Logger.Fatalf("Error changing interface name: %s", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error changing interface name: %s", err.Error())
 	}
-	c.Logger.Debugf("Renamed link from '%s' to '%s'", cIfNameTemp, cIfName)
+	c.Logger.Debugf("Renamed link from '%s' to '%s'", tempName, cIfName)
+	recordLinkChange("link.rename", cIfName, fmt.Sprintf("from '%s'", tempName))
 
 	//Bring macvlan interface online
 	if err = l.SetLinkUp(); err != nil {
-		c.Logger.Fatalf("Error bringing up macvlan interface: %s", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error bringing up macvlan interface: %s", err.Error())
 	}
 	c.Logger.Debugf("Brought link online: %s", l)
 
-	// Switch back to the original namespace
-	netns.Set(origns)
-
-	os.Exit(0)
+	return net.InterfaceByName(cIfName)
 }
 
-func (c *Container) setupContainerLink(parentLink string, linkOptions tenus.MacVlanOptions, containerName string) (*MacvlanLink, error) {
-
-	cmd := &exec.Cmd{
-		Path:   reexec.Self(),
-		Args:   append([]string{"setup-container-link"}, containerName, c.ID, parentLink, DockerHost, linkOptions.MacAddr, linkOptions.Dev),
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+func (c *Container) setupContainerLink(parentLink string, linkOptions tenus.MacVlanOptions, containerName string, cn *ContainerNetworkConfig) (*MacvlanLink, error) {
+	spec := linkSpec{
+		ContainerName: containerName,
+		ContainerID:   c.ID,
+		ParentLink:    parentLink,
+		DockerHost:    DockerHost,
+		MacAddr:       linkOptions.MacAddr,
+		Dev:           linkOptions.Dev,
+		Network:       *cn,
+		DADProbes:     DADProbes,
+		DADInterval:   DADInterval,
+		GARPCount:     GARPCount,
+		GARPInterval:  GARPInterval,
+		Verify:        VerifyConnectivity,
+		ProbeTimeout:  ProbeTimeout,
 	}
-
-	if err := cmd.Run(); err != nil {
-		c.Logger.Fatalf("Setup container link reexec command failed. Command - %s\n", err)
+	result, err := runLinkCommand("setup-container-link", spec)
+	mac := result.MacAddr
+	if mac == "" {
+		mac = linkOptions.MacAddr
+	}
+	c.auditLinkChanges(result.Changes, AuditEntry{
+		Mode:    cn.NetworkMode,
+		Parent:  parentLink,
+		VlanID:  cn.VlanID,
+		MacAddr: mac,
+		IPAddr:  cn.IPAddress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.MacAddr != "" {
+		linkOptions.MacAddr = result.MacAddr
 	}
 
 	return &MacvlanLink{
 		options: linkOptions,
 		name:    linkOptions.Dev,
+		result:  result,
 	}, nil
 
 }
+
+// runLinkCommand runs a container link reexec command with spec and returns
+// the result it reports.
+func runLinkCommand(command string, spec linkSpec) (linkResult, error) {
+	var result linkResult
+	arg, err := json.Marshal(spec)
+	if err != nil {
+		return result, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return result, err
+	}
+	defer r.Close()
+
+	cmd := &exec.Cmd{
+		Path:       reexec.Self(),
+		Args:       []string{command, string(arg)},
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{w},
+	}
+
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return result, fmt.Errorf("Reexec command '%s' failed: %s", command, err)
+	}
+	w.Close()
+
+	json.NewDecoder(r).Decode(&result)
+	if err := cmd.Wait(); err != nil {
+		if result.Error != "" {
+			return result, &setupError{result.Class, errors.New(result.Error)}
+		}
+		return result, fmt.Errorf("Reexec command '%s' failed: %s", command, err)
+	}
+	return result, nil
+}
+
+func reexecTeardownContainerLink() {
+	initializeLogger()
+
+	var spec linkSpec
+	if len(os.Args) < 2 {
+		Logger.Fatal("Missing container link specification")
+	}
+	if err := json.Unmarshal([]byte(os.Args[1]), &spec); err != nil {
+		Logger.Fatalf("Invalid container link specification: %s", err.Error())
+	}
+	c := NewContainer(spec.ContainerID)
+
+	if err := c.teardownContainerLinkInNamespace(&spec); err != nil {
+		c.Logger.Error(err.Error())
+		writeLinkResult(linkResult{Error: err.Error(), Class: errorClass(err), Changes: linkChanges})
+		os.Exit(1)
+	}
+	writeLinkResult(linkResult{Changes: linkChanges})
+	os.Exit(0)
+}
+
+// teardownContainerLinkInNamespace deletes the container link, its capture
+// veth and the firewall rules loaded with it. Qdiscs go with the link; sysctls
+// are kept.
+func (c *Container) teardownContainerLinkInNamespace(spec *linkSpec) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
+	ns, _, err := containerNetns(spec.ContainerName, spec.DockerHost)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+
+	if ifc, err := net.InterfaceByName(spec.Dev); err == nil {
+		c.removeMirrorInNamespace(spec.Dev, ifc.HardwareAddr.String())
+		if err := netlink.NetworkLinkDel(spec.Dev); err != nil {
+			return fmt.Errorf("Error deleting container link '%s': %s", spec.Dev, err.Error())
+		}
+		c.Logger.Debugf("Deleted container link '%s'", spec.Dev)
+		recordLinkChange("link.delete", spec.Dev, "")
+	}
+	if spec.Network.Firewall != "" {
+		if err := removeFirewall(spec.Dev); err != nil {
+			return &setupError{"firewall", err}
+		}
+		recordLinkChange("firewall.remove", spec.Dev, "")
+	}
+	return nil
+}
+
+func reexecShapeContainerLink() {
+	initializeLogger()
+
+	var spec linkSpec
+	if len(os.Args) < 2 {
+		Logger.Fatal("Missing container link specification")
+	}
+	if err := json.Unmarshal([]byte(os.Args[1]), &spec); err != nil {
+		Logger.Fatalf("Invalid container link specification: %s", err.Error())
+	}
+	c := NewContainer(spec.ContainerID)
+
+	if err := c.shapeContainerLinkInNamespace(&spec); err != nil {
+		c.Logger.Error(err.Error())
+		writeLinkResult(linkResult{Error: err.Error(), Class: errorClass(err), Changes: linkChanges})
+		os.Exit(1)
+	}
+	writeLinkResult(linkResult{Changes: linkChanges})
+	os.Exit(0)
+}
+
+// shapeContainerLinkInNamespace applies the bandwidth limits and impairment
+// of spec.Network to an existing container link and changes nothing else.
+func (c *Container) shapeContainerLinkInNamespace(spec *linkSpec) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
+	ns, _, err := containerNetns(spec.ContainerName, spec.DockerHost)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+
+	if _, err := net.InterfaceByName(spec.Dev); err != nil {
+		return fmt.Errorf("Container link '%s' does not exist", spec.Dev)
+	}
+	if err := applyShaping(spec.Dev, &spec.Network, spec.Previous); err != nil {
+		return &setupError{"shaping", err}
+	}
+	recordLinkChange("shaping.set", spec.Dev, fmt.Sprintf("egress '%s', ingress '%s', netem %v", spec.Network.EgressRate, spec.Network.IngressRate, spec.Network.Netem != nil))
+	return nil
+}
+
+// shapeContainerLink applies the shaping of cn to the link of a running
+// container, replacing the shaping of previous
+func (c *Container) shapeContainerLink(containerName string, cn, previous *ContainerNetworkConfig) error {
+	result, err := runLinkCommand("shape-container-link", linkSpec{
+		ContainerName: containerName,
+		ContainerID:   c.ID,
+		DockerHost:    DockerHost,
+		Dev:           cn.ifName(),
+		Network:       *cn,
+		Previous:      previous,
+	})
+	c.auditLinkChanges(result.Changes, AuditEntry{
+		Mode:   cn.NetworkMode,
+		VlanID: cn.VlanID,
+		IPAddr: cn.IPAddress,
+	})
+	return err
+}
+
+// teardownContainerLink removes the link setupContainerLink created
+func (c *Container) teardownContainerLink(containerName string, cn *ContainerNetworkConfig) error {
+	result, err := runLinkCommand("teardown-container-link", linkSpec{
+		ContainerName: containerName,
+		ContainerID:   c.ID,
+		DockerHost:    DockerHost,
+		Dev:           cn.ifName(),
+		Network:       *cn,
+	})
+	c.auditLinkChanges(result.Changes, AuditEntry{
+		Mode:   cn.NetworkMode,
+		VlanID: cn.VlanID,
+		IPAddr: cn.IPAddress,
+	})
+	return err
+}
@@ -5,13 +5,23 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	"github.com/urfave/cli"
 	"os"
+	"time"
 )
 
 var (
-	DockerHost   string
-	HostLinkName string
-	Logger       *logrus.Logger
-	version      string
+	DockerHost         string
+	HostLinkName       string
+	StateDir           string
+	NetnsDir           string
+	DADProbes          int
+	DADInterval        time.Duration
+	GARPCount          int
+	GARPInterval       time.Duration
+	VerifyConnectivity bool
+	ProbeTimeout       time.Duration
+	DryRun             bool
+	Logger             *logrus.Logger
+	version            string
 )
 
 func main() {
@@ -19,15 +29,41 @@ func main() {
 
 	app := initializeApp()
 
+	// CNI runtimes execute the plugin without arguments
+	if os.Getenv("CNI_COMMAND") != "" && len(os.Args) == 1 {
+		os.Args = append(os.Args, "cni")
+	}
+
 	app.Action = func(c *cli.Context) error {
-		DockerHost = c.String("docker-host")
-		HostLinkName = c.String("host-link")
+		if err := initializeGlobals(c); err != nil {
+			Logger.Fatal(err.Error())
+		}
 
 		d, err := initializeDocker(DockerHost)
 		if err != nil {
 			Logger.Fatalf("Failed initializing docker client: %s", err.Error())
 		}
 
+		if path := c.String("config"); path != "" {
+			ConfigReloader = &Reloader{
+				path:      path,
+				qosFlags:  c.StringSlice("vlan-qos"),
+				poolFlags: c.StringSlice("pool"),
+				reconcile: c.Bool("reconcile-on-reload"),
+				docker:    d,
+			}
+			go ConfigReloader.handleSignals()
+		}
+
+		if api := c.String("api"); api != "" {
+			serveAPI(api)
+		}
+		if socket := c.String("plugin-socket"); socket != "" && DryRun {
+			Logger.Warnln("Not serving the network plugin in a dry run")
+		} else if socket != "" {
+			servePlugin(socket, StateDir)
+		}
+
 		// Add event listener source them to events channel
 		events := make(chan *docker.APIEvents)
 		d.AddEventListener(events)
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+var (
+	metrics []metric
+
+	EventsReceived = newCounterVec("plumber_docker_events_total",
+		"Docker events received, by action.", "action")
+	SetupsAttempted = newCounterVec("plumber_setups_attempted_total",
+		"Container network setups attempted, by network mode.", "mode")
+	SetupsSucceeded = newCounterVec("plumber_setups_succeeded_total",
+		"Container network setups that succeeded, by network mode.", "mode")
+	SetupsFailed = newCounterVec("plumber_setups_failed_total",
+		"Container network setups that failed, by network mode and error class.", "mode", "class")
+	ConfigReloads = newCounterVec("plumber_config_reloads_total",
+		"Configuration reloads, by result.", "result")
+	SetupDuration = newHistogramVec("plumber_setup_duration_seconds",
+		"Latency of the container network setup stages.", defaultBuckets, "stage")
+
+	// The client of the registered event listener, nil when there is none
+	eventStreamClient *docker.Client
+	eventStreamLock   sync.RWMutex
+)
+
+func init() {
+	newGauge("plumber_managed_containers", "Containers with an online plumbed link.", func() float64 {
+		n := 0
+		for _, cs := range State.Containers() {
+			if cs.Status == StatusOnline {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	newGauge("plumber_parent_links", "Parent links referenced by at least one container.", func() float64 {
+		n := 0
+		for _, p := range State.Parents() {
+			if p.RefCount > 0 {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	newGauge("plumber_event_stream_connected", "Whether the Docker event stream is open and the daemon answers.", func() float64 {
+		eventStreamLock.RLock()
+		d := eventStreamClient
+		eventStreamLock.RUnlock()
+		if d == nil {
+			return 0
+		}
+		// The docker client keeps the stream open while it reconnects, so
+		// only a daemon that answers counts as connected
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := d.PingWithContext(ctx); err != nil {
+			return 0
+		}
+		return 1
+	})
+}
+
+func setEventStream(d *docker.Client) {
+	eventStreamLock.Lock()
+	defer eventStreamLock.Unlock()
+	eventStreamClient = d
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	metrics = append(metrics, h)
+	return h
+}
+
+func newGauge(name, help string, value func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[strings.Join(labelValues, "\xff")]++
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Since observes the time elapsed since start.
+func (h *histogramVec) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]float64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, formatLabels(c.labels, k), c.values[k])
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.values) {
+		s := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", fmt.Sprint(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, k), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+	}
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%s %v\n", g.name, g.value())
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/docker/libcontainer/netlink"
+	"github.com/milosgajdos83/tenus"
+	"github.com/vishvananda/netns"
+)
+
+// Mirror filters have a priority of their own, so they are replaced without
+// touching the ingress policer of shaping.
+const mirrorPrio = "49152"
+
+// mirrorLinkNames returns the names of the capture veth pair of a container
+// link: the end in the host namespace and the one in the container. They are
+// derived from the container ID and the link MAC, so every link of a
+// container has its own pair and it can be removed without state.
+func mirrorLinkNames(id string, mac string) (string, string) {
+	h := fnv.New32a()
+	h.Write([]byte(id + mac))
+	sum := h.Sum32()
+	return fmt.Sprintf("pmh%08x", sum), fmt.Sprintf("pmc%08x", sum)
+}
+
+// setupMirrorInNamespace copies the traffic of the container link dev to the
+// host interface mirror. Macvlan bridge mode delivers traffic between
+// containers on the same parent without passing the parent's qdiscs, so the
+// copy is taken on the container link itself. Mirred only reaches links in the
+// namespace of the filter, so it goes to the container end of a capture veth
+// pair and the host end redirects it to mirror. The calling goroutine must be
+// locked to its thread and is left in ns.
+func (c *Container) setupMirrorInNamespace(origns, ns netns.NsHandle, dev string, mac string, mirror string) error {
+	hostEnd, containerEnd := mirrorLinkNames(c.ID, mac)
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	if _, err := net.InterfaceByName(containerEnd); err != nil {
+		// Create the pair in the host namespace so the host end stays there
+		netns.Set(origns)
+		veth, err := tenus.NewVethPairWithOptions(hostEnd, tenus.VethOptions{PeerName: containerEnd})
+		if err != nil {
+			return fmt.Errorf("Error creating capture veth: %s", err.Error())
+		}
+		recordLinkChange("link.create", hostEnd, fmt.Sprintf("capture veth for '%s'", dev))
+		if err := netlink.NetworkSetNsFd(veth.PeerNetInterface(), int(ns)); err != nil {
+			veth.DeleteLink()
+			recordLinkChange("link.delete", hostEnd, "moving to the container namespace failed")
+			return fmt.Errorf("Error moving capture veth to container namespace: %s", err.Error())
+		}
+		if err := veth.SetLinkUp(); err != nil {
+			return fmt.Errorf("Error bringing up capture veth: %s", err.Error())
+		}
+		// Everything the container end sends is a copy for the mirror interface
+		tc("qdisc", "add", "dev", hostEnd, "clsact")
+		if err := tc("filter", "replace", "dev", hostEnd, "ingress", "protocol", "all", "prio", mirrorPrio,
+			"u32", "match", "u32", "0", "0", "action", "mirred", "egress", "redirect", "dev", mirror); err != nil {
+			return err
+		}
+
+		if err := netns.Set(ns); err != nil {
+			return fmt.Errorf("Error entering container namespace: %s", err.Error())
+		}
+		// The container end sends nothing of its own, not even IPv6 neighbor discovery
+		ioutil.WriteFile(filepath.Join("/proc/sys/net/ipv6/conf", containerEnd, "disable_ipv6"), []byte("1"), 0644)
+		ifc, err := net.InterfaceByName(containerEnd)
+		if err != nil {
+			return fmt.Errorf("Error finding capture veth: %s", err.Error())
+		}
+		if err := netlink.NetworkLinkUp(ifc); err != nil {
+			return fmt.Errorf("Error bringing up capture veth: %s", err.Error())
+		}
+	}
+
+	// The clsact qdisc may already be there for the ingress policer
+	tc("qdisc", "add", "dev", dev, "clsact")
+	for _, direction := range []string{"egress", "ingress"} {
+		tc("filter", "del", "dev", dev, direction, "prio", mirrorPrio)
+		if err := tc("filter", "add", "dev", dev, direction, "protocol", "all", "prio", mirrorPrio,
+			"u32", "match", "u32", "0", "0", "action", "mirred", "egress", "mirror", "dev", containerEnd); err != nil {
+			return err
+		}
+	}
+	c.Logger.Printf("Mirroring traffic of '%s' to '%s' through '%s'", dev, mirror, hostEnd)
+	recordLinkChange("mirror.create", dev, fmt.Sprintf("to '%s' through '%s'", mirror, hostEnd))
+	return nil
+}
+
+// removeMirrorInNamespace deletes the capture veth pair of a container link;
+// the filters go with the link. The calling thread must be in the container
+// namespace.
+func (c *Container) removeMirrorInNamespace(dev string, mac string) {
+	_, containerEnd := mirrorLinkNames(c.ID, mac)
+	if _, err := net.InterfaceByName(containerEnd); err != nil {
+		return
+	}
+	// Deleting either end deletes the pair
+	if err := netlink.NetworkLinkDel(containerEnd); err != nil {
+		c.Logger.Warnf("Failed deleting capture veth '%s': %s", containerEnd, err.Error())
+		return
+	}
+	recordLinkChange("mirror.remove", dev, fmt.Sprintf("deleted '%s'", containerEnd))
+}
+
+// removeMirror deletes the capture veth pair of a container's link. It
+// disappears with the container namespace, so this only matters while the
+// namespace is kept, e.g. by a named netns mount.
+func (c *Container) removeMirror() {
+	cs, ok := State.Container(c.ID)
+	if !ok || cs.Network.Mirror == "" || cs.MacAddr == "" {
+		return
+	}
+	hostEnd, _ := mirrorLinkNames(cs.ID, cs.MacAddr)
+	if _, err := net.InterfaceByName(hostEnd); err != nil {
+		return
+	}
+	if err := tenus.DeleteLink(hostEnd); err != nil {
+		c.Logger.Debugf("Failed deleting capture veth '%s': %s", hostEnd, err.Error())
+		return
+	}
+	c.Logger.Printf("Stopped mirroring traffic to '%s'", cs.Network.Mirror)
+	c.audit(AuditEntry{Event: "mirror.remove", Container: cs.Name, Link: hostEnd, MacAddr: cs.MacAddr, Detail: fmt.Sprintf("to '%s'", cs.Network.Mirror)})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestMirrorLinkNames(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, tt := range []struct{ id, mac string }{
+		{"3f4a1c2b9d8e", "02:42:ac:11:00:02"},
+		{"3f4a1c2b9d8e", "02:42:ac:11:00:03"},
+		{"9b1c00d4e5f6", "02:42:ac:11:00:02"},
+	} {
+		hostEnd, containerEnd := mirrorLinkNames(tt.id, tt.mac)
+		// The main link and the attachments of a container each get their own pair
+		if seen[hostEnd] || seen[containerEnd] || hostEnd == containerEnd {
+			t.Errorf("mirrorLinkNames(%s, %s) = %s, %s, which is already used", tt.id, tt.mac, hostEnd, containerEnd)
+		}
+		seen[hostEnd], seen[containerEnd] = true, true
+		if len(hostEnd) > 15 || len(containerEnd) > 15 {
+			t.Errorf("mirrorLinkNames(%s, %s) = %s, %s, longer than an interface name may be", tt.id, tt.mac, hostEnd, containerEnd)
+		}
+		if h, c := mirrorLinkNames(tt.id, tt.mac); h != hostEnd || c != containerEnd {
+			t.Errorf("mirrorLinkNames(%s, %s) is not stable", tt.id, tt.mac)
+		}
+	}
+}
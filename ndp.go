@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ethPIPv6                    = 0x86dd
+	icmpv6NeighborAdvertisement = 136
+	ndpOptTargetLinkLayerAddr   = 2
+	ndpFlagOverride             = 0x20000000
+)
+
+var allNodesMulticast = net.ParseIP("ff02::1")
+
+// neighborAdvertisement builds an unsolicited neighbor advertisement frame
+// for target with the override flag set (RFC 4861 section 7.2.6)
+func neighborAdvertisement(mac net.HardwareAddr, target net.IP) []byte {
+	const payloadLen = 32
+	b := make([]byte, 14+40+payloadLen)
+	// Ethernet header to the all nodes multicast address
+	copy(b[0:6], []byte{0x33, 0x33, 0, 0, 0, 1})
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], ethPIPv6)
+
+	ip := b[14:54]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], payloadLen)
+	ip[6] = 58 // ICMPv6
+	ip[7] = 255
+	copy(ip[8:24], target.To16())
+	copy(ip[24:40], allNodesMulticast)
+
+	icmp := b[54:]
+	icmp[0] = icmpv6NeighborAdvertisement
+	binary.BigEndian.PutUint32(icmp[4:8], ndpFlagOverride)
+	copy(icmp[8:24], target.To16())
+	icmp[24] = ndpOptTargetLinkLayerAddr
+	icmp[25] = 1
+	copy(icmp[26:32], mac)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip[8:24], ip[24:40], icmp))
+	return b
+}
+
+// icmpv6Checksum computes the checksum over the IPv6 pseudo header and message
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	var pseudo [8]byte
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(msg)))
+	pseudo[7] = 58
+	add(pseudo[:])
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
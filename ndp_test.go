@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestNeighborAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	target := net.ParseIP("2001:db8::5")
+	frame := neighborAdvertisement(mac, target)
+
+	if len(frame) != 14+40+32 {
+		t.Fatalf("Frame is %d bytes, want %d", len(frame), 14+40+32)
+	}
+	for _, tt := range []struct {
+		field     string
+		got, want []byte
+	}{
+		{"destination MAC", frame[0:6], []byte{0x33, 0x33, 0, 0, 0, 1}},
+		{"source MAC", frame[6:12], mac},
+		{"ethertype", frame[12:14], []byte{0x86, 0xdd}},
+		{"IPv6 version", frame[14:15], []byte{0x60}},
+		{"payload length", frame[18:20], []byte{0, 32}},
+		{"next header and hop limit", frame[20:22], []byte{58, 255}},
+		{"source address", frame[22:38], target},
+		{"destination address", frame[38:54], net.ParseIP("ff02::1")},
+		{"ICMPv6 type and code", frame[54:56], []byte{136, 0}},
+		{"override flag", frame[58:62], []byte{0x20, 0, 0, 0}},
+		{"target address", frame[62:78], target},
+		{"target link-layer address option", frame[78:80], []byte{2, 1}},
+		{"option MAC", frame[80:86], mac},
+	} {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("The %s is % x, want % x", tt.field, tt.got, tt.want)
+		}
+	}
+
+	// The checksum over the pseudo header and a message with its checksum is zero
+	if sum := icmpv6Checksum(frame[22:38], frame[38:54], frame[54:]); sum != 0 {
+		t.Errorf("Checksum does not verify, got %#04x", sum)
+	}
+	icmp := append([]byte{}, frame[54:]...)
+	binary.BigEndian.PutUint16(icmp[2:4], 0)
+	if sum := icmpv6Checksum(frame[22:38], frame[38:54], icmp); binary.BigEndian.Uint16(frame[56:58]) != sum {
+		t.Errorf("Checksum is %#04x, want %#04x", binary.BigEndian.Uint16(frame[56:58]), sum)
+	}
+}
+
+func TestICMPv6Checksum(t *testing.T) {
+	src := net.ParseIP("fe80::1")
+	dst := net.ParseIP("ff02::1")
+	// An echo request with an odd length payload, checksum computed independently
+	msg := []byte{128, 0, 0, 0, 0, 1, 0, 1, 0xab}
+	if sum := icmpv6Checksum(src, dst, msg); sum != 0xd733 {
+		t.Errorf("icmpv6Checksum = %#04x, want 0xd733", sum)
+	}
+}
+
+func TestGratuitousARPFrame(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip := net.ParseIP("10.0.0.5")
+	// Announcements are requests with the address as both sender and target
+	p := parseARP(arpFrame(arpRequest, mac, ip, make(net.HardwareAddr, 6), ip))
+	if p == nil || p.op != arpRequest || !p.senderIP.Equal(ip) || !p.targetIP.Equal(ip) || !bytes.Equal(p.senderMAC, mac) {
+		t.Errorf("Gratuitous ARP parses as %+v", p)
+	}
+}
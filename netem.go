@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Netem impairs the traffic a container sends, e.g. to emulate a WAN link.
+// Durations are Go durations such as '100ms'; rates are percentages.
+type Netem struct {
+	Delay     string `json:"delay,omitempty" yaml:"delay"`
+	Jitter    string `json:"jitter,omitempty" yaml:"jitter"`
+	Loss      string `json:"loss,omitempty" yaml:"loss"`
+	Duplicate string `json:"duplicate,omitempty" yaml:"duplicate"`
+	Reorder   string `json:"reorder,omitempty" yaml:"reorder"`
+}
+
+func (n *Netem) empty() bool {
+	return *n == Netem{}
+}
+
+func parsePercentage(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("Invalid percentage '%s'", s)
+	}
+	return p, nil
+}
+
+func (n *Netem) validate() error {
+	for _, d := range []struct{ name, value string }{{"delay", n.Delay}, {"jitter", n.Jitter}} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return fmt.Errorf("Invalid netem %s '%s'", d.name, d.value)
+		}
+	}
+	for _, p := range []struct{ name, value string }{{"loss", n.Loss}, {"duplicate", n.Duplicate}, {"reorder", n.Reorder}} {
+		if p.value == "" {
+			continue
+		}
+		if _, err := parsePercentage(p.value); err != nil {
+			return fmt.Errorf("Invalid netem %s: %s", p.name, err.Error())
+		}
+	}
+	if n.Delay == "" && (n.Jitter != "" || n.Reorder != "") {
+		return fmt.Errorf("Netem jitter and reorder require a delay")
+	}
+	return nil
+}
+
+// args returns the tc arguments for the netem qdisc
+func (n *Netem) args() []string {
+	usec := func(s string) string {
+		d, _ := time.ParseDuration(s)
+		return fmt.Sprintf("%dus", d.Nanoseconds()/1000)
+	}
+	percent := func(s string) string {
+		p, _ := parsePercentage(s)
+		return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+	}
+	args := []string{"netem"}
+	if n.Delay != "" {
+		args = append(args, "delay", usec(n.Delay))
+		if n.Jitter != "" {
+			args = append(args, usec(n.Jitter))
+		}
+	}
+	if n.Loss != "" {
+		args = append(args, "loss", percent(n.Loss))
+	}
+	if n.Duplicate != "" {
+		args = append(args, "duplicate", percent(n.Duplicate))
+	}
+	if n.Reorder != "" {
+		args = append(args, "reorder", percent(n.Reorder))
+	}
+	return args
+}
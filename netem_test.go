@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestNetemValidate(t *testing.T) {
+	for _, tt := range []struct {
+		netem Netem
+		valid bool
+	}{
+		{Netem{}, true},
+		{Netem{Delay: "100ms", Jitter: "10ms", Reorder: "25%"}, true},
+		{Netem{Loss: "0.5%", Duplicate: "1"}, true},
+		{Netem{Loss: "100"}, true},
+		{Netem{Delay: "100"}, false},
+		{Netem{Delay: "-1ms"}, false},
+		{Netem{Delay: "100ms", Jitter: "1 ms"}, false},
+		{Netem{Loss: "101%"}, false},
+		{Netem{Loss: "-1%"}, false},
+		{Netem{Duplicate: "some"}, false},
+		{Netem{Jitter: "10ms"}, false},
+		{Netem{Reorder: "25%"}, false},
+	} {
+		if err := tt.netem.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) returned %v, want valid %v", tt.netem, err, tt.valid)
+		}
+	}
+}
+
+func TestNetemArgs(t *testing.T) {
+	for _, tt := range []struct {
+		netem Netem
+		args  string
+	}{
+		{Netem{}, "netem"},
+		{Netem{Delay: "100ms"}, "netem delay 100000us"},
+		{Netem{Delay: "1.5s", Jitter: "250us"}, "netem delay 1500000us 250us"},
+		{Netem{Delay: "20ms", Reorder: "25"}, "netem delay 20000us reorder 25%"},
+		{Netem{Loss: "0.5%", Duplicate: "1"}, "netem loss 0.5% duplicate 1%"},
+	} {
+		if args := strings.Join(tt.netem.args(), " "); args != tt.args {
+			t.Errorf("args(%+v) = %s, want %s", tt.netem, args, tt.args)
+		}
+	}
+}
+
+func TestSetNetem(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	store := State
+	defer func() { State = store }()
+	State = NewStore()
+	State.Update("3f4a1c2b9d8e", func(cs *ContainerState) {
+		cs.Name = "/web"
+		cs.Status = StatusStopped
+	})
+	State.Update("3f4a1c2b0000", func(cs *ContainerState) {
+		cs.Name = "/db"
+		cs.Status = StatusOnline
+	})
+
+	// Requests that fail before the link is touched
+	for _, tt := range []struct {
+		method, ref, body string
+		status            int
+	}{
+		{"PUT", "cache", `{"delay": "100ms"}`, http.StatusNotFound},
+		{"DELETE", "cache", "", http.StatusNotFound},
+		{"PUT", "3f4a1c2b", `{"delay": "100ms"}`, http.StatusBadRequest},
+		{"PUT", "db", `{"delay": 100}`, http.StatusBadRequest},
+		{"PUT", "db", `{"delay": "100ms"`, http.StatusBadRequest},
+		{"PUT", "db", `{"loss": "150%"}`, http.StatusBadRequest},
+		{"PUT", "db", `{"jitter": "10ms"}`, http.StatusBadRequest},
+		{"PUT", "web", `{"delay": "100ms"}`, http.StatusConflict},
+		{"DELETE", "web", "", http.StatusConflict},
+	} {
+		req := httptest.NewRequest(tt.method, "/containers/"+tt.ref+"/netem", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		newAPIRouter().ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with %s returned %d, want %d: %s", tt.method, tt.ref, tt.body, w.Code, tt.status, w.Body)
+		}
+	}
+
+	// Failed requests leave the state alone
+	if cs, _ := State.Container("db"); cs.Network.Netem != nil {
+		t.Errorf("Netem of 'db' changed to %+v", cs.Network.Netem)
+	}
+	if cs, _ := State.Container("web"); cs.Status != StatusStopped || cs.Network.Netem != nil {
+		t.Errorf("State of 'web' changed to %+v", cs)
+	}
+}
+
+func TestNetemLabels(t *testing.T) {
+	cn := ContainerNetworkConfig{}
+	for key, value := range map[string]string{"netem.delay": "100ms", "netem.loss": "1%"} {
+		if err := labelSetters[key](&cn, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := (&Netem{Delay: "100ms", Loss: "1%"}); !reflect.DeepEqual(cn.Netem, want) {
+		t.Errorf("Netem labels set %+v, want %+v", cn.Netem, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// prepareNetnsDir makes dir a shared mount, like 'ip netns' does, so the
+// namespace mounts in it propagate to other mount namespaces.
+func prepareNetnsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	err := syscall.Mount("", dir, "none", syscall.MS_SHARED|syscall.MS_REC, "")
+	if err == syscall.EINVAL {
+		// Not a mount point yet
+		if err := syscall.Mount(dir, dir, "none", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		err = syscall.Mount("", dir, "none", syscall.MS_SHARED|syscall.MS_REC, "")
+	}
+	return err
+}
+
+// netnsPath returns where the network namespace of a container is mounted
+func netnsPath(containerName string) string {
+	return filepath.Join(NetnsDir, strings.TrimPrefix(containerName, "/"))
+}
+
+// mountNamedNetns bind-mounts the network namespace of process pid to the
+// netns directory under the container name, so 'ip netns exec' can use it.
+func (c *Container) mountNamedNetns(containerName string, pid int) (string, error) {
+	if err := prepareNetnsDir(NetnsDir); err != nil {
+		return "", fmt.Errorf("Error preparing netns directory '%s': %s", NetnsDir, err.Error())
+	}
+	path := netnsPath(containerName)
+	// Replace the mount of a previous run of the container
+	syscall.Unmount(path, syscall.MNT_DETACH)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0444)
+	if err != nil {
+		return "", fmt.Errorf("Error creating '%s': %s", path, err.Error())
+	}
+	f.Close()
+	if err := syscall.Mount(fmt.Sprintf("/proc/%d/ns/net", pid), path, "none", syscall.MS_BIND, ""); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("Error mounting network namespace on '%s': %s", path, err.Error())
+	}
+	return path, nil
+}
+
+// removeNamedNetns unmounts and removes the named network namespace of a container
+func (c *Container) removeNamedNetns() {
+	cs, ok := State.Container(c.ID)
+	if !ok || cs.Netns == "" {
+		return
+	}
+	if err := syscall.Unmount(cs.Netns, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		c.Logger.Warnf("Failed unmounting '%s': %s", cs.Netns, err.Error())
+	}
+	if err := os.Remove(cs.Netns); err != nil && !os.IsNotExist(err) {
+		c.Logger.Warnf("Failed removing '%s': %s", cs.Netns, err.Error())
+	}
+	c.audit(AuditEntry{Event: "netns.unmount", Container: cs.Name, Detail: cs.Netns})
+	State.Update(c.ID, func(cs *ContainerState) {
+		cs.Netns = ""
+	})
+}
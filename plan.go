@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netns"
+)
+
+func planCommand() cli.Command {
+	return cli.Command{
+		Name:   "plan",
+		Usage:  "Print the network changes plumber would make for the running containers without making them",
+		Action: runPlan,
+	}
+}
+
+func runPlan(ctx *cli.Context) error {
+	if err := initializeGlobals(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	d, err := initializeDocker(DockerHost)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed initializing docker client: %s", err.Error()), 1)
+	}
+	containers, err := d.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to get containers: %s", err.Error()), 1)
+	}
+
+	failed := 0
+	for _, container := range containers {
+		c := NewContainer(container.ID[0:12])
+		info, err := containerInfo(d, c.ID)
+		if err != nil {
+			fmt.Printf("%s (%s)\n  error: %s\n", strings.Join(container.Names, ","), c.ID, err.Error())
+			failed++
+			continue
+		}
+		steps, err := c.planContainerNetwork(info)
+		if len(steps) == 0 && err == nil {
+			continue
+		}
+		fmt.Printf("%s (%s)\n", info.Name, c.ID)
+		for _, step := range steps {
+			fmt.Printf("  %s\n", step)
+		}
+		if err != nil {
+			fmt.Printf("  error: %s\n", err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d container(s) would fail", failed), 1)
+	}
+	return nil
+}
+
+// logPlan logs the changes the network setup of a container would make
+func (c *Container) logPlan(containerInfo *docker.Container) {
+	steps, err := c.planContainerNetwork(containerInfo)
+	for _, step := range steps {
+		c.Logger.Printf("Dry run for '%s': %s", containerInfo.Name, step)
+	}
+	if err != nil {
+		c.Logger.Errorf("Dry run for '%s': %s", containerInfo.Name, err.Error())
+	}
+}
+
+// planContainerNetwork returns the changes handleContainerNetwork would make,
+// in order, for the network of the labels up to its first error and then for
+// each attachment. Nothing is changed.
+func (c *Container) planContainerNetwork(containerInfo *docker.Container) ([]string, error) {
+	steps, err := c.planLabelNetwork(containerInfo)
+	if Attachments == nil {
+		return steps, err
+	}
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	attachments, aerr := Attachments.List(containerInfo.Name)
+	if aerr != nil {
+		errs = append(errs, fmt.Sprintf("attachments: %s", aerr.Error()))
+	}
+	for _, a := range attachments {
+		cn := a.Network.clone()
+		attachmentSteps, aerr := c.planAttachment(containerInfo, &cn)
+		for _, step := range attachmentSteps {
+			steps = append(steps, fmt.Sprintf("attachment '%s': %s", cn.IfName, step))
+		}
+		if aerr != nil {
+			errs = append(errs, fmt.Sprintf("attachment '%s': %s", cn.IfName, aerr.Error()))
+		}
+	}
+	if len(errs) == 1 && err != nil {
+		return steps, err
+	}
+	if len(errs) > 0 {
+		return steps, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return steps, nil
+}
+
+// planLabelNetwork plans the network the labels of a container ask for
+func (c *Container) planLabelNetwork(containerInfo *docker.Container) ([]string, error) {
+	cn, err := c.getContainerNetworkConfig(containerInfo)
+	if err != nil || cn.NetworkMode == "" {
+		return nil, err
+	}
+	if _, err := checkPolicy(containerInfo, &cn); err != nil {
+		return nil, err
+	}
+	if cn.NetworkMode != "macvlan" {
+		return nil, &setupError{"config", fmt.Errorf("I do not know how to setup '%s' network", cn.NetworkMode)}
+	}
+	return c.planMacvlanNetwork(containerInfo.Name, containerInfo.State.Pid, &cn)
+}
+
+// planAttachment follows setupAttachment
+func (c *Container) planAttachment(containerInfo *docker.Container, cn *ContainerNetworkConfig) ([]string, error) {
+	if _, err := checkPolicy(containerInfo, cn); err != nil {
+		return nil, err
+	}
+	return c.planMacvlanLink(containerInfo.Name, containerInfo.State.Pid, cn)
+}
+
+// planMacvlanNetwork follows setupMacvlanNetwork, reading the host and the
+// container namespace but not changing them.
+func (c *Container) planMacvlanNetwork(containerName string, pid int, cn *ContainerNetworkConfig) ([]string, error) {
+	steps, err := c.planMacvlanLink(containerName, pid, cn)
+	if err != nil {
+		return steps, err
+	}
+	if cn.Mirror != "" {
+		steps = append(steps, fmt.Sprintf("mirror the traffic of '%s' to '%s' through a capture veth", cn.ifName(), cn.Mirror))
+	}
+	if NetnsDir != "" {
+		steps = append(steps, fmt.Sprintf("mount the network namespace on '%s'", netnsPath(containerName)))
+	}
+	return steps, nil
+}
+
+// parentLinkName returns the name of the link setupParentLink returns for cn
+func parentLinkName(cn *ContainerNetworkConfig) string {
+	if cn.VlanID == "" {
+		return cn.parent()
+	}
+	vlanID, _ := strconv.ParseUint(cn.VlanID, 0, 12)
+	return fmt.Sprintf("%s.%d", cn.parent(), vlanID)
+}
+
+// planMacvlanLink follows setupMacvlanLink
+func (c *Container) planMacvlanLink(containerName string, pid int, cn *ContainerNetworkConfig) ([]string, error) {
+	var steps []string
+	if err := cn.validate(); err != nil {
+		return steps, &setupError{"config", err}
+	}
+	if cn.Mirror != "" {
+		if _, err := net.InterfaceByName(cn.Mirror); err != nil {
+			return steps, &setupError{"config", fmt.Errorf("Invalid mirror interface '%s': %s", cn.Mirror, err.Error())}
+		}
+	}
+	if cn.IPAM != "" {
+		pool, err := addressPool(cn)
+		if err != nil {
+			return steps, err
+		}
+		ip, err := currentIPAM().Peek(pool.Name, leaseOwner(containerName, cn), "")
+		if err != nil {
+			return steps, &setupError{"ipam", err}
+		}
+		cn.IPAddress, cn.Gateway = pool.CIDR(ip), pool.Gateway
+		steps = append(steps, fmt.Sprintf("lease address '%s' from pool '%s'", cn.IPAddress, pool.Name))
+	}
+
+	hostLink := cn.parent()
+	if _, err := net.InterfaceByName(hostLink); err != nil {
+		return steps, &setupError{"parent", fmt.Errorf("Host link '%s' does not exist", hostLink)}
+	}
+	parentLink := parentLinkName(cn)
+	if cn.VlanID != "" {
+		vlanID, _ := strconv.ParseUint(cn.VlanID, 0, 12)
+		if ifc, err := net.InterfaceByName(parentLink); err == nil {
+			steps = append(steps, fmt.Sprintf("use existing VLAN link '%s' (%s)", parentLink, ifc.HardwareAddr))
+		} else {
+			steps = append(steps, fmt.Sprintf("create VLAN link '%s' with ID %d on '%s' with a random MAC", parentLink, vlanID, hostLink))
+		}
+		qos := cn.VlanQoS
+		if qos == nil {
+			qos = configuredVlanQoS(fmt.Sprint(vlanID))
+		}
+		if qos != nil && (qos.EgressMap != "" || qos.IngressMap != "") {
+			steps = append(steps, fmt.Sprintf("set QoS mappings of '%s' to egress '%s', ingress '%s'", parentLink, qos.EgressMap, qos.IngressMap))
+		}
+	}
+
+	ifName := cn.ifName()
+	exists, err := linkInNetns(pid, ifName)
+	if err != nil {
+		return steps, err
+	}
+	if exists {
+		steps = append(steps, fmt.Sprintf("keep existing link '%s' in the container", ifName))
+	} else {
+		tempName := fmt.Sprintf("mcv%v", pid)
+		steps = append(steps,
+			fmt.Sprintf("create macvlan link '%s' on '%s' with a random MAC", tempName, parentLink),
+			fmt.Sprintf("move '%s' into the network namespace of PID %d", tempName, pid),
+			fmt.Sprintf("rename '%s' to '%s' and bring it up", tempName, ifName))
+	}
+	if cn.MTU > 0 {
+		steps = append(steps, fmt.Sprintf("set MTU of '%s' to %d", ifName, cn.MTU))
+	}
+	if cn.Firewall != "" {
+		steps = append(steps, fmt.Sprintf("load firewall rules '%s'", cn.Firewall))
+	}
+	keys := make([]string, 0, len(cn.Sysctls))
+	for key := range cn.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		steps = append(steps, fmt.Sprintf("set sysctl %s to '%s'", key, cn.Sysctls[key]))
+	}
+	if cn.Netem != nil {
+		steps = append(steps, fmt.Sprintf("impair egress of '%s' with '%s'", ifName, strings.Join(cn.Netem.args(), " ")))
+	}
+	if cn.EgressRate != "" {
+		steps = append(steps, fmt.Sprintf("limit egress of '%s' to %s", ifName, cn.EgressRate))
+	}
+	if cn.IngressRate != "" {
+		steps = append(steps, fmt.Sprintf("limit ingress of '%s' to %s", ifName, cn.IngressRate))
+	}
+	if cn.IPAddress != "" {
+		steps = append(steps, fmt.Sprintf("assign address '%s' to '%s'", cn.IPAddress, ifName))
+		if cn.Gateway != "" {
+			steps = append(steps, fmt.Sprintf("add default route via '%s'", cn.Gateway))
+		}
+	}
+	return steps, nil
+}
+
+// linkInNetns reports whether the network namespace of pid has a link named
+// name. Tests replace it to plan without a container.
+var linkInNetns = func(pid int, name string) (bool, error) {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return false, fmt.Errorf("Error getting container namespace: %s", err.Error())
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origns, err := netns.Get()
+	if err != nil {
+		return false, fmt.Errorf("Error saving current NS: %s", err.Error())
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+	if err := netns.Set(ns); err != nil {
+		return false, fmt.Errorf("Error entering container namespace: %s", err.Error())
+	}
+	_, err = net.InterfaceByName(name)
+	return err == nil, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// fakeLinksInNetns makes linkInNetns report the links in links, and returns a
+// function restoring it
+func fakeLinksInNetns(links ...string) func() {
+	lookup := linkInNetns
+	linkInNetns = func(pid int, name string) (bool, error) {
+		for _, l := range links {
+			if l == name {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return func() { linkInNetns = lookup }
+}
+
+func TestPlanMacvlanLink(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	defer func(name string) { HostLinkName = name }(HostLinkName)
+	// The loopback link is the host link every test host has
+	HostLinkName = "lo"
+	setVlanQoSConfig(map[string]*VlanQoS{"3134": {EgressMap: "0:3"}})
+	defer setVlanQoSConfig(make(map[string]*VlanQoS))
+	defer setIPAM(currentIPAM())
+	am, cleanup := testAddressManager(t, "name=backoffice,subnet=10.0.0.0/24,gateway=10.0.0.1")
+	defer cleanup()
+	setIPAM(am)
+	defer fakeLinksInNetns("eth2")()
+
+	for _, tt := range []struct {
+		cn    ContainerNetworkConfig
+		steps []string
+		class string
+	}{
+		{ContainerNetworkConfig{NetworkMode: "macvlan"}, []string{
+			"create macvlan link 'mcv42' on 'lo' with a random MAC",
+			"move 'mcv42' into the network namespace of PID 42",
+			"rename 'mcv42' to 'lo' and bring it up",
+		}, ""},
+		{ContainerNetworkConfig{
+			NetworkMode: "macvlan",
+			IfName:      "eth2",
+			VlanID:      "0xc3e",
+			MTU:         1400,
+			Firewall:    "in tcp/22",
+			Sysctls:     map[string]string{"net.ipv4.tcp_syncookies": "1", "net.ipv4.conf.eth2.rp_filter": "2"},
+			Netem:       &Netem{Delay: "10ms", Loss: "1%"},
+			EgressRate:  "100mbit",
+			IngressRate: "10mbit",
+			IPAddress:   "10.0.1.5/24",
+			Gateway:     "10.0.1.1",
+		}, []string{
+			"create VLAN link 'lo.3134' with ID 3134 on 'lo' with a random MAC",
+			"set QoS mappings of 'lo.3134' to egress '0:3', ingress ''",
+			"keep existing link 'eth2' in the container",
+			"set MTU of 'eth2' to 1400",
+			"load firewall rules 'in tcp/22'",
+			"set sysctl net.ipv4.conf.eth2.rp_filter to '2'",
+			"set sysctl net.ipv4.tcp_syncookies to '1'",
+			"impair egress of 'eth2' with 'netem delay 10000us loss 1%'",
+			"limit egress of 'eth2' to 100mbit",
+			"limit ingress of 'eth2' to 10mbit",
+			"assign address '10.0.1.5/24' to 'eth2'",
+			"add default route via '10.0.1.1'",
+		}, ""},
+		// Planning peeks at the pool without leasing
+		{ContainerNetworkConfig{NetworkMode: "macvlan", IPAM: "pool:backoffice", IfName: "eth2"}, []string{
+			"lease address '10.0.0.2/24' from pool 'backoffice'",
+			"keep existing link 'eth2' in the container",
+			"assign address '10.0.0.2/24' to 'eth2'",
+			"add default route via '10.0.0.1'",
+		}, ""},
+		{ContainerNetworkConfig{NetworkMode: "macvlan", IPAM: "pool:backoffice", IfName: "eth2"}, []string{
+			"lease address '10.0.0.2/24' from pool 'backoffice'",
+			"keep existing link 'eth2' in the container",
+			"assign address '10.0.0.2/24' to 'eth2'",
+			"add default route via '10.0.0.1'",
+		}, ""},
+		{ContainerNetworkConfig{NetworkMode: "macvlan", IPAM: "pool:frontoffice"}, nil, "config"},
+		{ContainerNetworkConfig{NetworkMode: "macvlan", VlanID: "4096"}, nil, "config"},
+		{ContainerNetworkConfig{NetworkMode: "macvlan", Mirror: "plumbertest0"}, nil, "config"},
+		{ContainerNetworkConfig{NetworkMode: "macvlan", Parent: "plumbertest0"}, nil, "parent"},
+	} {
+		cn := tt.cn
+		steps, err := NewContainer("3f4a1c2b9d8e").planMacvlanLink("/web", 42, &cn)
+		if tt.class != "" {
+			if errorClass(err) != tt.class {
+				t.Errorf("planMacvlanLink(%+v) returned %v, want a %s error", tt.cn, err, tt.class)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("planMacvlanLink(%+v) failed: %s", tt.cn, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, tt.steps) {
+			t.Errorf("planMacvlanLink(%+v) planned\n%q\nwant\n%q", tt.cn, steps, tt.steps)
+		}
+	}
+	if leases, _ := am.Leases(); len(leases) != 0 {
+		t.Errorf("Planning leased %v", leases)
+	}
+}
+
+func TestPlanContainerNetwork(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	defer func(name string) { HostLinkName = name }(HostLinkName)
+	HostLinkName = "lo"
+	defer func(dir string) { NetnsDir = dir }(NetnsDir)
+	NetnsDir = "/var/run/netns"
+	defer func(store *AttachmentStore) { Attachments = store }(Attachments)
+	Attachments = nil
+	defer fakeLinksInNetns("lo")()
+
+	info := func(labels map[string]string) *docker.Container {
+		return &docker.Container{Name: "/web", Config: &docker.Config{Image: "nginx", Labels: labels}, State: docker.State{Pid: 42}}
+	}
+	for _, tt := range []struct {
+		labels map[string]string
+		steps  []string
+		err    bool
+	}{
+		{nil, nil, false},
+		{map[string]string{"plumber.network.vlanid": "100"}, nil, false},
+		{map[string]string{"plumber.network.mode": "macvlan"}, []string{
+			"keep existing link 'lo' in the container",
+			"mount the network namespace on '/var/run/netns/web'",
+		}, false},
+		{map[string]string{"plumber.network.mode": "bridge"}, nil, true},
+		{map[string]string{"plumber.network.profile": "missing"}, nil, true},
+	} {
+		steps, err := NewContainer("3f4a1c2b9d8e").planContainerNetwork(info(tt.labels))
+		if (err != nil) != tt.err || !reflect.DeepEqual(steps, tt.steps) {
+			t.Errorf("planContainerNetwork(%v) = %q, %v, want %q, error %v", tt.labels, steps, err, tt.steps, tt.err)
+		}
+	}
+}
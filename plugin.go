@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/milosgajdos83/tenus"
+)
+
+const pluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+// Docker passes driver options given with 'docker network create --opt' under this key
+const genericOptionsKey = "com.docker.network.generic"
+
+// PluginNetwork is a docker network created with the plumber driver.
+type PluginNetwork struct {
+	ID         string   `json:"id"`
+	HostLink   string   `json:"hostLink"`
+	VlanID     string   `json:"vlanId,omitempty"`
+	Mode       string   `json:"mode"`
+	ParentLink string   `json:"parentLink"`
+	Gateway    string   `json:"gateway,omitempty"`
+	QoS        *VlanQoS `json:"qos,omitempty"`
+}
+
+// PluginEndpoint is a container endpoint on a plumber network.
+type PluginEndpoint struct {
+	ID        string `json:"id"`
+	NetworkID string `json:"networkId"`
+	MacAddr   string `json:"macAddress"`
+	LinkName  string `json:"linkName"`
+}
+
+type pluginState struct {
+	Networks  map[string]*PluginNetwork  `json:"networks"`
+	Endpoints map[string]*PluginEndpoint `json:"endpoints"`
+}
+
+// NetworkDriver implements the libnetwork remote network driver protocol
+type NetworkDriver struct {
+	sync.Mutex
+	path       string
+	state      pluginState
+	implements []string
+}
+
+type pluginInterface struct {
+	Address     string `json:",omitempty"`
+	AddressIPv6 string `json:",omitempty"`
+	MacAddress  string `json:",omitempty"`
+}
+
+type ipamData struct {
+	AddressSpace string
+	Pool         string
+	Gateway      string
+	AuxAddresses map[string]string
+}
+
+type createNetworkRequest struct {
+	NetworkID string
+	Options   map[string]interface{}
+	IPv4Data  []ipamData
+	IPv6Data  []ipamData
+}
+
+type networkRequest struct {
+	NetworkID string
+}
+
+type createEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *pluginInterface
+	Options    map[string]interface{}
+}
+
+type endpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+type joinRequest struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Options    map[string]interface{}
+}
+
+type joinResponse struct {
+	InterfaceName struct {
+		SrcName   string
+		DstPrefix string
+	}
+	Gateway string `json:",omitempty"`
+}
+
+func NewNetworkDriver(stateDir string) (*NetworkDriver, error) {
+	nd := &NetworkDriver{
+		path:       filepath.Join(stateDir, "plugin.json"),
+		implements: []string{"NetworkDriver"},
+		state: pluginState{
+			Networks:  make(map[string]*PluginNetwork),
+			Endpoints: make(map[string]*PluginEndpoint),
+		},
+	}
+	// Docker does not recreate networks when the plugin restarts, so they are persisted
+	if err := readJSONFile(nd.path, &nd.state); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+func servePlugin(addr string, stateDir string) {
+	nd, err := NewNetworkDriver(stateDir)
+	if err != nil {
+		Logger.Fatalf("Failed loading network driver state: %s", err.Error())
+	}
+	r := nd.router()
+	// The IPAM driver shares the socket, so both are available under the plumber
+	// name. Docker only activates a plugin once, so it is there even while no
+	// pools are configured, for pools a reload adds.
+	(&IPAMDriver{}).register(r)
+	nd.implements = append(nd.implements, "IpamDriver")
+	l, err := listen(addr)
+	if err != nil {
+		Logger.Fatalf("Failed starting plugin listener: %s", err.Error())
+	}
+	Logger.Printf("Network plugin listening on: %s", addr)
+	go func() {
+		if err := http.Serve(l, r); err != nil {
+			Logger.Errorf("Plugin listener stopped: %s", err.Error())
+		}
+	}()
+}
+
+func (nd *NetworkDriver) router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/Plugin.Activate", nd.activate).Methods("POST")
+	r.HandleFunc("/NetworkDriver.GetCapabilities", nd.getCapabilities).Methods("POST")
+	r.HandleFunc("/NetworkDriver.CreateNetwork", nd.createNetwork).Methods("POST")
+	r.HandleFunc("/NetworkDriver.DeleteNetwork", nd.deleteNetwork).Methods("POST")
+	r.HandleFunc("/NetworkDriver.CreateEndpoint", nd.createEndpoint).Methods("POST")
+	r.HandleFunc("/NetworkDriver.EndpointOperInfo", nd.endpointOperInfo).Methods("POST")
+	r.HandleFunc("/NetworkDriver.DeleteEndpoint", nd.deleteEndpoint).Methods("POST")
+	r.HandleFunc("/NetworkDriver.Join", nd.join).Methods("POST")
+	r.HandleFunc("/NetworkDriver.Leave", nd.leave).Methods("POST")
+	for _, noop := range []string{"AllocateNetwork", "FreeNetwork", "DiscoverNew", "DiscoverDelete",
+		"ProgramExternalConnectivity", "RevokeExternalConnectivity"} {
+		r.HandleFunc("/NetworkDriver."+noop, nd.noop).Methods("POST")
+	}
+	return r
+}
+
+func (nd *NetworkDriver) logger(networkID string) *logrus.Entry {
+	return Logger.WithFields(logrus.Fields{"Network": shortID(networkID)})
+}
+
+// save persists the driver state; callers hold the lock
+func (nd *NetworkDriver) save() error {
+	return writeJSONFile(nd.path, nd.state)
+}
+
+func writePluginResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writePluginError(w http.ResponseWriter, err error) {
+	Logger.Errorf("Network plugin: %s", err.Error())
+	w.Header().Set("Content-Type", pluginContentType)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"Err": err.Error()})
+}
+
+func decodePluginRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writePluginError(w, fmt.Errorf("Failed decoding request: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+// genericOptions returns the driver options passed with the network as strings
+func genericOptions(options map[string]interface{}) map[string]string {
+	opts := make(map[string]string)
+	generic, ok := options[genericOptionsKey].(map[string]interface{})
+	if !ok {
+		return opts
+	}
+	for k, v := range generic {
+		opts[k] = fmt.Sprint(v)
+	}
+	return opts
+}
+
+func (nd *NetworkDriver) activate(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, map[string][]string{"Implements": nd.implements})
+}
+
+func (nd *NetworkDriver) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, map[string]string{"Scope": "local", "ConnectivityScope": "local"})
+}
+
+func (nd *NetworkDriver) noop(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, struct{}{})
+}
+
+func (nd *NetworkDriver) createNetwork(w http.ResponseWriter, r *http.Request) {
+	var req createNetworkRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	opts := genericOptions(req.Options)
+	n := &PluginNetwork{
+		ID:       req.NetworkID,
+		HostLink: HostLinkName,
+		VlanID:   opts["vlanid"],
+		Mode:     "macvlan",
+	}
+	if parent := opts["parent"]; parent != "" {
+		n.HostLink = parent
+	}
+	if opts["egress-qos-map"] != "" || opts["ingress-qos-map"] != "" {
+		n.QoS = &VlanQoS{EgressMap: opts["egress-qos-map"], IngressMap: opts["ingress-qos-map"]}
+	}
+	if mode := opts["mode"]; mode != "" && mode != n.Mode {
+		writePluginError(w, fmt.Errorf("I do not know how to setup '%s' network", mode))
+		return
+	}
+	if len(req.IPv4Data) > 0 && req.IPv4Data[0].Gateway != "" {
+		n.Gateway = strings.Split(req.IPv4Data[0].Gateway, "/")[0]
+	}
+
+	c := &Container{ID: shortID(n.ID), Logger: nd.logger(n.ID)}
+	parentLink, err := c.setupParentLink(n.HostLink, n.VlanID, n.QoS)
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+	n.ParentLink = parentLink
+	c.Logger.Printf("Created network on parent link '%s'", parentLink)
+
+	nd.Lock()
+	defer nd.Unlock()
+	nd.state.Networks[n.ID] = n
+	if err := nd.save(); err != nil {
+		writePluginError(w, err)
+		return
+	}
+	writePluginResponse(w, struct{}{})
+}
+
+func (nd *NetworkDriver) deleteNetwork(w http.ResponseWriter, r *http.Request) {
+	var req networkRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	delete(nd.state.Networks, req.NetworkID)
+	if err := nd.save(); err != nil {
+		writePluginError(w, err)
+		return
+	}
+	nd.logger(req.NetworkID).Println("Deleted network")
+	writePluginResponse(w, struct{}{})
+}
+
+func (nd *NetworkDriver) createEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req createEndpointRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	if _, ok := nd.state.Networks[req.NetworkID]; !ok {
+		writePluginError(w, fmt.Errorf("No such network: %s", req.NetworkID))
+		return
+	}
+	ep := &PluginEndpoint{
+		ID:        req.EndpointID,
+		NetworkID: req.NetworkID,
+		LinkName:  tempLinkName(req.EndpointID),
+	}
+	resp := map[string]interface{}{}
+	if req.Interface != nil && req.Interface.MacAddress != "" {
+		ep.MacAddr = req.Interface.MacAddress
+	} else {
+		// Only the fields docker did not provide may be returned
+		ep.MacAddr = generateMAC()
+		resp["Interface"] = pluginInterface{MacAddress: ep.MacAddr}
+	}
+	nd.state.Endpoints[ep.ID] = ep
+	if err := nd.save(); err != nil {
+		writePluginError(w, err)
+		return
+	}
+	writePluginResponse(w, resp)
+}
+
+func (nd *NetworkDriver) endpointOperInfo(w http.ResponseWriter, r *http.Request) {
+	var req endpointRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	value := map[string]string{}
+	if ep, ok := nd.state.Endpoints[req.EndpointID]; ok {
+		value["macAddress"] = ep.MacAddr
+		value["linkName"] = ep.LinkName
+	}
+	writePluginResponse(w, map[string]interface{}{"Value": value})
+}
+
+func (nd *NetworkDriver) deleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req endpointRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	if ep, ok := nd.state.Endpoints[req.EndpointID]; ok {
+		deleteHostLink(ep.LinkName)
+		delete(nd.state.Endpoints, req.EndpointID)
+	}
+	if err := nd.save(); err != nil {
+		writePluginError(w, err)
+		return
+	}
+	writePluginResponse(w, struct{}{})
+}
+
+func (nd *NetworkDriver) join(w http.ResponseWriter, r *http.Request) {
+	var req joinRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	n, ok := nd.state.Networks[req.NetworkID]
+	if !ok {
+		writePluginError(w, fmt.Errorf("No such network: %s", req.NetworkID))
+		return
+	}
+	ep, ok := nd.state.Endpoints[req.EndpointID]
+	if !ok {
+		writePluginError(w, fmt.Errorf("No such endpoint: %s", req.EndpointID))
+		return
+	}
+
+	// The VLAN link of the network does not survive a reboot, the network does
+	c := &Container{ID: shortID(n.ID), Logger: nd.logger(n.ID)}
+	parentLink, err := c.setupParentLink(n.HostLink, n.VlanID, n.QoS)
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+	if parentLink != n.ParentLink {
+		n.ParentLink = parentLink
+		if err := nd.save(); err != nil {
+			writePluginError(w, err)
+			return
+		}
+	}
+
+	// Docker moves the link into the sandbox and renames it before the entrypoint runs
+	l, err := tenus.NewMacVlanLinkWithOptions(n.ParentLink, tenus.MacVlanOptions{
+		Dev:     ep.LinkName,
+		MacAddr: ep.MacAddr,
+		Mode:    "bridge",
+	})
+	if err != nil {
+		writePluginError(w, fmt.Errorf("Error creating macvlan link: %s", err.Error()))
+		return
+	}
+	nd.logger(n.ID).Printf("Created link '%s' on '%s' for endpoint %s: %v", ep.LinkName, n.ParentLink, shortID(ep.ID), l.NetInterface().HardwareAddr)
+	Audit.Write(AuditEntry{
+		Event:   "link.create",
+		Mode:    n.Mode,
+		Parent:  n.ParentLink,
+		VlanID:  n.VlanID,
+		Link:    ep.LinkName,
+		MacAddr: ep.MacAddr,
+		Detail:  fmt.Sprintf("endpoint %s of network %s", shortID(ep.ID), shortID(n.ID)),
+		Outcome: "succeeded",
+	})
+
+	var resp joinResponse
+	resp.InterfaceName.SrcName = ep.LinkName
+	resp.InterfaceName.DstPrefix = "eth"
+	resp.Gateway = n.Gateway
+	writePluginResponse(w, resp)
+}
+
+func (nd *NetworkDriver) leave(w http.ResponseWriter, r *http.Request) {
+	var req endpointRequest
+	if !decodePluginRequest(w, r, &req) {
+		return
+	}
+	nd.Lock()
+	defer nd.Unlock()
+	if ep, ok := nd.state.Endpoints[req.EndpointID]; ok {
+		// The link is returned to the host namespace when the sandbox is torn down
+		deleteHostLink(ep.LinkName)
+	}
+	writePluginResponse(w, struct{}{})
+}
+
+// deleteHostLink removes a link from the host namespace if it is there.
+func deleteHostLink(name string) {
+	if err := tenus.DeleteLink(name); err != nil {
+		Logger.Debugf("Link '%s' not deleted: %s", name, err.Error())
+		return
+	}
+	Audit.Write(AuditEntry{Event: "link.delete", Link: name, Outcome: "succeeded"})
+}
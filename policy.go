@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// PolicyRule allows or denies the networks of the containers it matches. All
+// criteria that are set must match, and any value of a criterion may match.
+// Images, registries and label values are shell patterns, e.g.
+// 'registry.example.com/backoffice/*'; VLANs are IDs or ranges like '3100-3199'.
+type PolicyRule struct {
+	Name       string            `json:"name,omitempty" yaml:"name"`
+	Action     string            `json:"action" yaml:"action"`
+	Images     []string          `json:"images,omitempty" yaml:"images"`
+	Registries []string          `json:"registries,omitempty" yaml:"registries"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels"`
+	Vlans      []string          `json:"vlans,omitempty" yaml:"vlans"`
+	Parents    []string          `json:"parents,omitempty" yaml:"parents"`
+	Modes      []string          `json:"modes,omitempty" yaml:"modes"`
+}
+
+// Policy decides which containers may set up which networks. The first rule
+// that matches a container applies, otherwise the default, which is allow.
+type Policy struct {
+	Default string        `json:"default,omitempty" yaml:"default"`
+	Rules   []*PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyRequest is what a container asks for
+type PolicyRequest struct {
+	Image   string
+	Labels  map[string]string
+	Network *ContainerNetworkConfig
+}
+
+// imageRegistry returns the registry of an image reference, e.g. docker.io
+// for 'nginx:1.13'
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
+
+// imageName strips the tag and digest from an image reference
+func imageName(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func parseVlanRange(s string) (uint64, uint64, error) {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 0, 12)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid VLAN '%s'", s)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 12); err != nil || last < first {
+			return 0, 0, fmt.Errorf("Invalid VLAN range '%s'", s)
+		}
+	}
+	return first, last, nil
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if ok, _ := path.Match(p, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) validate() error {
+	if r.Action != PolicyAllow && r.Action != PolicyDeny {
+		return fmt.Errorf("Invalid action '%s', expected '%s' or '%s'", r.Action, PolicyAllow, PolicyDeny)
+	}
+	patterns := append(append([]string{}, r.Images...), r.Registries...)
+	for _, v := range r.Labels {
+		patterns = append(patterns, v)
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s'", p)
+		}
+	}
+	for _, v := range r.Vlans {
+		if _, _, err := parseVlanRange(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) matches(req *PolicyRequest) bool {
+	if len(r.Images) > 0 && !matchAny(r.Images, req.Image, imageName(req.Image)) {
+		return false
+	}
+	if len(r.Registries) > 0 && !matchAny(r.Registries, imageRegistry(req.Image)) {
+		return false
+	}
+	for key, pattern := range r.Labels {
+		value, ok := req.Labels[key]
+		if !ok || !matchAny([]string{pattern}, value) {
+			return false
+		}
+	}
+	if len(r.Vlans) > 0 {
+		id, err := strconv.ParseUint(req.Network.VlanID, 0, 12)
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, v := range r.Vlans {
+			first, last, _ := parseVlanRange(v)
+			if id >= first && id <= last {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Parents) > 0 && !matchAny(r.Parents, req.Network.parent()) {
+		return false
+	}
+	if len(r.Modes) > 0 && !matchAny(r.Modes, req.Network.NetworkMode) {
+		return false
+	}
+	return true
+}
+
+func (p *Policy) validate() error {
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return fmt.Errorf("Invalid default '%s', expected '%s' or '%s'", p.Default, PolicyAllow, PolicyDeny)
+	}
+	for i, r := range p.Rules {
+		if r == nil {
+			return fmt.Errorf("Rule %d is empty", i+1)
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("Rule %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// evaluate returns whether req is allowed and the rule that decided it. A nil
+// policy allows everything.
+func (p *Policy) evaluate(req *PolicyRequest) (bool, string) {
+	if p == nil {
+		return true, "no policy"
+	}
+	for i, r := range p.Rules {
+		if r.matches(req) {
+			name := r.Name
+			if name == "" {
+				name = fmt.Sprintf("rule %d", i+1)
+			}
+			return r.Action == PolicyAllow, name
+		}
+	}
+	return p.Default != PolicyDeny, "default"
+}
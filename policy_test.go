@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := &Policy{
+		Default: PolicyDeny,
+		Rules: []*PolicyRule{
+			{Name: "no-dmz", Action: PolicyDeny, Vlans: []string{"3100-3199"}, Labels: map[string]string{"zone": "dmz*"}},
+			{Name: "backoffice", Action: PolicyAllow, Registries: []string{"registry.example.com"}, Images: []string{"registry.example.com/backoffice/*"}},
+			{Action: PolicyAllow, Images: []string{"nginx"}, Vlans: []string{"3134", "0x100"}},
+			{Name: "bridge", Action: PolicyAllow, Modes: []string{"bridge"}, Parents: []string{"eth1*"}},
+		},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("Policy is invalid: %s", err)
+	}
+
+	for _, tt := range []struct {
+		image  string
+		labels map[string]string
+		cn     ContainerNetworkConfig
+		allow  bool
+		rule   string
+	}{
+		{"registry.example.com/backoffice/api:1.2", map[string]string{"zone": "dmz-east"}, ContainerNetworkConfig{VlanID: "3150"}, false, "no-dmz"},
+		{"registry.example.com/backoffice/api:1.2", map[string]string{"zone": "internal"}, ContainerNetworkConfig{VlanID: "3150"}, true, "backoffice"},
+		{"registry.example.com/backoffice/api@sha256:abc", nil, ContainerNetworkConfig{VlanID: "3200"}, true, "backoffice"},
+		{"registry.example.com/frontoffice/web", nil, ContainerNetworkConfig{VlanID: "3134"}, false, "default"},
+		{"nginx:1.13", nil, ContainerNetworkConfig{VlanID: "3134"}, true, "rule 3"},
+		{"nginx", nil, ContainerNetworkConfig{VlanID: "256"}, true, "rule 3"},
+		{"nginx", nil, ContainerNetworkConfig{VlanID: "3135"}, false, "default"},
+		{"nginx", nil, ContainerNetworkConfig{}, false, "default"},
+		{"redis", nil, ContainerNetworkConfig{NetworkMode: "bridge", Parent: "eth1.3134"}, true, "bridge"},
+		{"redis", nil, ContainerNetworkConfig{NetworkMode: "bridge", Parent: "eth0"}, false, "default"},
+	} {
+		allow, rule := policy.evaluate(&PolicyRequest{Image: tt.image, Labels: tt.labels, Network: &tt.cn})
+		if allow != tt.allow || rule != tt.rule {
+			t.Errorf("evaluate(%s, %v, %+v) = %v, %s, want %v, %s", tt.image, tt.labels, tt.cn, allow, rule, tt.allow, tt.rule)
+		}
+	}
+
+	var none *Policy
+	if allow, rule := none.evaluate(&PolicyRequest{Image: "nginx", Network: &ContainerNetworkConfig{}}); !allow || rule != "no policy" {
+		t.Errorf("A nil policy returned %v, %s", allow, rule)
+	}
+	open := &Policy{Rules: []*PolicyRule{{Action: PolicyDeny, Images: []string{"nginx"}}}}
+	if allow, rule := open.evaluate(&PolicyRequest{Image: "redis", Network: &ContainerNetworkConfig{}}); !allow || rule != "default" {
+		t.Errorf("The default default returned %v, %s", allow, rule)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, tt := range []struct {
+		policy Policy
+		valid  bool
+	}{
+		{Policy{}, true},
+		{Policy{Default: PolicyAllow, Rules: []*PolicyRule{{Action: PolicyDeny, Vlans: []string{"1-4094"}}}}, true},
+		{Policy{Default: "reject"}, false},
+		{Policy{Rules: []*PolicyRule{nil}}, false},
+		{Policy{Rules: []*PolicyRule{{Action: "permit"}}}, false},
+		{Policy{Rules: []*PolicyRule{{Action: PolicyAllow, Images: []string{"[nginx"}}}}, false},
+		{Policy{Rules: []*PolicyRule{{Action: PolicyAllow, Labels: map[string]string{"zone": "[dmz"}}}}, false},
+		{Policy{Rules: []*PolicyRule{{Action: PolicyAllow, Vlans: []string{"4096"}}}}, false},
+		{Policy{Rules: []*PolicyRule{{Action: PolicyAllow, Vlans: []string{"200-100"}}}}, false},
+	} {
+		if err := tt.policy.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) returned %v, want valid %v", tt.policy, err, tt.valid)
+		}
+	}
+}
+
+func TestImageRegistryAndName(t *testing.T) {
+	for _, tt := range []struct {
+		image, registry, name string
+	}{
+		{"nginx", "docker.io", "nginx"},
+		{"nginx:1.13", "docker.io", "nginx"},
+		{"library/nginx:1.13", "docker.io", "library/nginx"},
+		{"localhost/app", "localhost", "localhost/app"},
+		{"registry.example.com:5000/team/app:2", "registry.example.com:5000", "registry.example.com:5000/team/app"},
+		{"registry.example.com/app@sha256:abc", "registry.example.com", "registry.example.com/app"},
+	} {
+		if got := imageRegistry(tt.image); got != tt.registry {
+			t.Errorf("imageRegistry(%s) = %s, want %s", tt.image, got, tt.registry)
+		}
+		if got := imageName(tt.image); got != tt.name {
+			t.Errorf("imageName(%s) = %s, want %s", tt.image, got, tt.name)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	NetworkReachable   = "reachable"
+	NetworkUnreachable = "unreachable"
+	NetworkUnknown     = "unknown"
+)
+
+// probeTargetFor returns the IPv4 address to probe after setting up the link
+// of cn: its probe target, or its gateway when verify is set. It returns nil
+// when there is nothing to probe.
+func probeTargetFor(cn *ContainerNetworkConfig, verify bool) (net.IP, error) {
+	target := cn.ProbeTarget
+	if target == "" && verify {
+		target = cn.Gateway
+	}
+	if target == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(target).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid probe target '%s'", target)
+	}
+	return ip, nil
+}
+
+// arpResolve sends ARP requests for target on ifc until a reply arrives
+// or the timeout expires. Without an own IPv4 address the requests are sent
+// as probes, which hosts answer as well.
+func arpResolve(ifc *net.Interface, source net.IP, target net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	a, err := openARP(ifc)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	if source == nil {
+		source = net.IPv4zero
+	}
+	end := time.Now().Add(timeout)
+	for time.Now().Before(end) {
+		if err := a.send(arpRequest, source, make(net.HardwareAddr, 6), target); err != nil {
+			return nil, fmt.Errorf("Error sending ARP request: %s", err.Error())
+		}
+		deadline := time.Now().Add(time.Second)
+		if deadline.After(end) {
+			deadline = end
+		}
+		for {
+			p, err := a.receive(deadline)
+			if err != nil {
+				return nil, fmt.Errorf("Error receiving ARP packets: %s", err.Error())
+			}
+			if p == nil {
+				break
+			}
+			if p.op == arpReply && p.senderIP.Equal(target) {
+				return p.senderMAC, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ping sends ICMP echo requests to target until a reply arrives or the timeout expires
+func ping(target net.IP, timeout time.Duration) (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return false, fmt.Errorf("Error opening ICMP socket: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	id := uint16(os.Getpid())
+	addr := &syscall.SockaddrInet4{}
+	copy(addr.Addr[:], target.To4())
+	b := make([]byte, 1500)
+	end := time.Now().Add(timeout)
+	for seq := uint16(1); time.Now().Before(end); seq++ {
+		req := make([]byte, 16)
+		req[0] = 8 // echo request
+		binary.BigEndian.PutUint16(req[4:6], id)
+		binary.BigEndian.PutUint16(req[6:8], seq)
+		binary.BigEndian.PutUint16(req[2:4], inetChecksum(req))
+		if err := syscall.Sendto(fd, req, 0, addr); err != nil {
+			return false, fmt.Errorf("Error sending ICMP echo request: %s", err.Error())
+		}
+		deadline := time.Now().Add(time.Second)
+		if deadline.After(end) {
+			deadline = end
+		}
+		for {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				break
+			}
+			tv := syscall.NsecToTimeval(wait.Nanoseconds())
+			if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+				return false, err
+			}
+			n, _, err := syscall.Recvfrom(fd, b, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			// Raw IPv4 sockets receive the IP header too
+			hl := int(b[0]&0x0f) * 4
+			if n < hl+8 || !net.IP(b[12:16]).Equal(target) {
+				continue
+			}
+			reply := b[hl:n]
+			if reply[0] == 0 && binary.BigEndian.Uint16(reply[4:6]) == id {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func inetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// probeConnectivity checks that target is reachable from ifc. On-link targets,
+// and any target while ifc has no IPv4 address yet, are ARP-resolved; others
+// are pinged. It returns a status and a human readable detail.
+func probeConnectivity(ifc *net.Interface, target net.IP, timeout time.Duration) (string, string, error) {
+	var source net.IP
+	onLink := false
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return "", "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			if source == nil {
+				source = ipNet.IP.To4()
+			}
+			if ipNet.Contains(target) {
+				source = ipNet.IP.To4()
+				onLink = true
+			}
+		}
+	}
+
+	if onLink || source == nil {
+		mac, err := arpResolve(ifc, source, target, timeout)
+		if err != nil {
+			return "", "", err
+		}
+		if mac == nil {
+			return NetworkUnreachable, fmt.Sprintf("No ARP reply from '%s' within %s", target, timeout), nil
+		}
+		return NetworkReachable, fmt.Sprintf("'%s' is at %s", target, mac), nil
+	}
+
+	ok, err := ping(target, timeout)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return NetworkUnreachable, fmt.Sprintf("No ICMP echo reply from '%s' within %s", target, timeout), nil
+	}
+	return NetworkReachable, fmt.Sprintf("'%s' answers ICMP echo", target), nil
+}
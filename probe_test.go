@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestProbeTargetFor(t *testing.T) {
+	for _, tt := range []struct {
+		cn     ContainerNetworkConfig
+		verify bool
+		want   string
+	}{
+		{ContainerNetworkConfig{}, false, ""},
+		{ContainerNetworkConfig{}, true, ""},
+		{ContainerNetworkConfig{Gateway: "10.0.0.1"}, false, ""},
+		{ContainerNetworkConfig{Gateway: "10.0.0.1"}, true, "10.0.0.1"},
+		{ContainerNetworkConfig{ProbeTarget: "10.0.0.254", Gateway: "10.0.0.1"}, false, "10.0.0.254"},
+		{ContainerNetworkConfig{ProbeTarget: "10.0.0.254", Gateway: "10.0.0.1"}, true, "10.0.0.254"},
+		{ContainerNetworkConfig{ProbeTarget: "::ffff:10.0.0.254"}, false, "10.0.0.254"},
+		{ContainerNetworkConfig{ProbeTarget: "fd00::1"}, false, "error"},
+		{ContainerNetworkConfig{ProbeTarget: "gateway"}, false, "error"},
+		{ContainerNetworkConfig{ProbeTarget: "10.0.0.0/24"}, false, "error"},
+		{ContainerNetworkConfig{Gateway: "fd00::1"}, true, "error"},
+	} {
+		ip, err := probeTargetFor(&tt.cn, tt.verify)
+		switch {
+		case tt.want == "error" && err == nil:
+			t.Errorf("probeTargetFor(%+v, %v) = %s, want an error", tt.cn, tt.verify, ip)
+		case tt.want == "error":
+		case err != nil:
+			t.Errorf("probeTargetFor(%+v, %v) failed: %s", tt.cn, tt.verify, err)
+		case tt.want == "" && ip != nil:
+			t.Errorf("probeTargetFor(%+v, %v) = %s, want nothing to probe", tt.cn, tt.verify, ip)
+		case tt.want != "" && (len(ip) != 4 || ip.String() != tt.want):
+			t.Errorf("probeTargetFor(%+v, %v) = %v, want %s", tt.cn, tt.verify, []byte(ip), tt.want)
+		}
+	}
+}
+
+func TestInetChecksum(t *testing.T) {
+	for _, tt := range []struct {
+		b    []byte
+		want uint16
+	}{
+		// The example of RFC 1071 section 3
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, ^uint16(0xddf2)},
+		{[]byte{0x08, 0x00, 0x00, 0x00, 0x12, 0x34, 0x00, 0x01}, 0xe5ca},
+		{[]byte{0xff}, 0x00ff},
+		{nil, 0xffff},
+	} {
+		if got := inetChecksum(tt.b); got != tt.want {
+			t.Errorf("inetChecksum(% x) = %#04x, want %#04x", tt.b, got, tt.want)
+		}
+	}
+
+	// A message with its checksum filled in sums to zero
+	req := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 7, 'p', 'l', 'u', 'm', 'b', 'e', 'r', 0}
+	binary.BigEndian.PutUint16(req[2:4], inetChecksum(req))
+	if sum := inetChecksum(req); sum != 0 {
+		t.Errorf("Checksum does not verify, got %#04x", sum)
+	}
+}
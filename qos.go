@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VlanQoS maps priorities to and from 802.1p PCP values on a VLAN link in
+// ip-link notation, e.g. '0:3 1:5'. The egress map takes socket priorities to
+// PCP values, the ingress map PCP values to socket priorities.
+type VlanQoS struct {
+	EgressMap  string `json:"egressQosMap,omitempty" yaml:"egressQosMap"`
+	IngressMap string `json:"ingressQosMap,omitempty" yaml:"ingressQosMap"`
+}
+
+var (
+	vlanQoSLock sync.RWMutex
+	// vlanQoSConfig holds the configured mappings per VLAN ID in decimal
+	vlanQoSConfig = make(map[string]*VlanQoS)
+)
+
+// configuredVlanQoS returns the mappings configured for a VLAN, or nil
+func configuredVlanQoS(vlanID string) *VlanQoS {
+	vlanQoSLock.RLock()
+	defer vlanQoSLock.RUnlock()
+	return vlanQoSConfig[vlanID]
+}
+
+func setVlanQoSConfig(config map[string]*VlanQoS) {
+	vlanQoSLock.Lock()
+	defer vlanQoSLock.Unlock()
+	vlanQoSConfig = config
+}
+
+// normalizeVlanID returns a VLAN ID in decimal, the way VLAN QoS mappings are
+// keyed; invalid IDs are returned as they are
+func normalizeVlanID(vlanID string) string {
+	id, err := strconv.ParseUint(vlanID, 0, 12)
+	if err != nil {
+		return vlanID
+	}
+	return fmt.Sprint(id)
+}
+
+// parseVlanQoSFlag parses a VLAN priority mapping given on the command line, e.g.
+// vlanid=3134,egress=0:3 1:5,ingress=5:5
+func parseVlanQoSFlag(s string) (string, *VlanQoS, error) {
+	var vlanID string
+	qos := &VlanQoS{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("Invalid VLAN QoS option '%s'", kv)
+		}
+		switch parts[0] {
+		case "vlanid":
+			vlanID = parts[1]
+		case "egress":
+			qos.EgressMap = parts[1]
+		case "ingress":
+			qos.IngressMap = parts[1]
+		default:
+			return "", nil, fmt.Errorf("Unknown VLAN QoS option '%s'", parts[0])
+		}
+	}
+	id, err := strconv.ParseUint(vlanID, 0, 12)
+	if err != nil {
+		return "", nil, fmt.Errorf("VLAN QoS '%s' requires a valid vlanid", s)
+	}
+	if err := qos.validate(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprint(id), qos, nil
+}
+
+// parseQoSMap parses 'from:to' pairs; maxFrom and maxTo bound the values
+func parseQoSMap(s string, maxFrom, maxTo uint64) (map[uint64]uint64, error) {
+	m := make(map[uint64]uint64)
+	for _, pair := range strings.Fields(s) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid QoS mapping '%s'", pair)
+		}
+		from, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || from > maxFrom {
+			return nil, fmt.Errorf("Invalid QoS mapping '%s'", pair)
+		}
+		to, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || to > maxTo {
+			return nil, fmt.Errorf("Invalid QoS mapping '%s'", pair)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+func (q *VlanQoS) validate() error {
+	if _, err := parseQoSMap(q.EgressMap, 1<<32-1, 7); err != nil {
+		return fmt.Errorf("Invalid egress QoS map: %s", err.Error())
+	}
+	if _, err := parseQoSMap(q.IngressMap, 7, 1<<32-1); err != nil {
+		return fmt.Errorf("Invalid ingress QoS map: %s", err.Error())
+	}
+	return nil
+}
+
+// readVlanQoS reads the current mappings of a VLAN link from /proc/net/vlan.
+// The kernel lists all eight ingress mappings and the non-zero egress ones.
+func readVlanQoS(dev string) (map[uint64]uint64, map[uint64]uint64, error) {
+	f, err := os.Open(filepath.Join("/proc/net/vlan", dev))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	ingress, egress := make(map[uint64]uint64), make(map[uint64]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var m map[uint64]uint64
+		switch {
+		case strings.HasPrefix(line, "INGRESS priority mappings:"):
+			m = ingress
+		case strings.HasPrefix(line, "EGRESS priority mappings:"):
+			m = egress
+		default:
+			continue
+		}
+		current, err := parseQoSMap(line[strings.Index(line, ":")+1:], 1<<32-1, 1<<32-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range current {
+			if v != 0 {
+				m[k] = v
+			}
+		}
+	}
+	return ingress, egress, scanner.Err()
+}
+
+// qosChanges returns the 'from:to' pairs turning current into desired.
+// Mappings missing from desired are reset to zero.
+func qosChanges(current, desired map[uint64]uint64) []string {
+	var changes []string
+	for from, to := range desired {
+		if current[from] != to {
+			changes = append(changes, fmt.Sprintf("%d:%d", from, to))
+		}
+	}
+	for from := range current {
+		if _, ok := desired[from]; !ok {
+			changes = append(changes, fmt.Sprintf("%d:0", from))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// qosMapsEqual reports whether two mappings agree, a missing mapping being zero
+func qosMapsEqual(a, b map[uint64]uint64) bool {
+	for from, to := range a {
+		if b[from] != to {
+			return false
+		}
+	}
+	for from, to := range b {
+		if a[from] != to {
+			return false
+		}
+	}
+	return true
+}
+
+// checkVlanQoS returns an error when the mappings a container or network asks
+// for conflict with those of VLAN vlanID, which its link dev shares with every
+// container on it. They conflict with the configured mappings of the VLAN, and
+// with the current ones of dev when it exists, so a request can only set the
+// mappings of a new link and never change them for the other containers.
+func checkVlanQoS(vlanID string, dev string, qos *VlanQoS) error {
+	configured := configuredVlanQoS(vlanID)
+	if configured == nil {
+		configured = &VlanQoS{}
+	}
+	var currentIngress, currentEgress map[uint64]uint64
+	if fileExists(filepath.Join("/proc/net/vlan", dev)) {
+		var err error
+		if currentIngress, currentEgress, err = readVlanQoS(dev); err != nil {
+			return fmt.Errorf("Error reading QoS mappings of '%s': %s", dev, err.Error())
+		}
+	}
+	for _, m := range []struct {
+		direction         string
+		requested, config string
+		current           map[uint64]uint64
+		maxFrom, maxTo    uint64
+	}{
+		{"egress", qos.EgressMap, configured.EgressMap, currentEgress, 1<<32 - 1, 7},
+		{"ingress", qos.IngressMap, configured.IngressMap, currentIngress, 7, 1<<32 - 1},
+	} {
+		if m.requested == "" {
+			continue
+		}
+		requested, _ := parseQoSMap(m.requested, m.maxFrom, m.maxTo)
+		if m.config != "" {
+			if config, _ := parseQoSMap(m.config, m.maxFrom, m.maxTo); !qosMapsEqual(requested, config) {
+				return fmt.Errorf("The %s QoS map '%s' conflicts with '%s' configured for VLAN %s", m.direction, m.requested, m.config, vlanID)
+			}
+		}
+		if m.current != nil && !qosMapsEqual(requested, m.current) {
+			return fmt.Errorf("The %s QoS map '%s' conflicts with the current mappings of '%s'", m.direction, m.requested, dev)
+		}
+	}
+	return nil
+}
+
+// applyVlanQoS sets the priority mappings of a VLAN link when they differ
+// from the configured ones. It returns whether the link was changed.
+func applyVlanQoS(dev string, qos *VlanQoS) (bool, error) {
+	if qos == nil || (qos.EgressMap == "" && qos.IngressMap == "") {
+		return false, nil
+	}
+	currentIngress, currentEgress, err := readVlanQoS(dev)
+	if err != nil {
+		return false, fmt.Errorf("Error reading QoS mappings of '%s': %s", dev, err.Error())
+	}
+	args := []string{"link", "set", "dev", dev, "type", "vlan"}
+	changed := false
+	if qos.EgressMap != "" {
+		desired, _ := parseQoSMap(qos.EgressMap, 1<<32-1, 7)
+		if changes := qosChanges(currentEgress, desired); len(changes) > 0 {
+			args = append(append(args, "egress-qos-map"), changes...)
+			changed = true
+		}
+	}
+	if qos.IngressMap != "" {
+		desired, _ := parseQoSMap(qos.IngressMap, 7, 1<<32-1)
+		if changes := qosChanges(currentIngress, desired); len(changes) > 0 {
+			args = append(append(args, "ingress-qos-map"), changes...)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("ip", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("Error setting QoS mappings of '%s': %s: %s", dev, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
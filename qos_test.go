@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVlanQoSFlag(t *testing.T) {
+	for _, tt := range []struct {
+		flag   string
+		vlanID string
+		qos    *VlanQoS
+	}{
+		{"vlanid=3134,egress=0:3 1:5,ingress=5:5", "3134", &VlanQoS{EgressMap: "0:3 1:5", IngressMap: "5:5"}},
+		{"vlanid=0xc3e,egress=0:3", "3134", &VlanQoS{EgressMap: "0:3"}},
+		{"ingress=7:4294967295,vlanid=100", "100", &VlanQoS{IngressMap: "7:4294967295"}},
+		{"egress=0:3", "", nil},
+		{"vlanid=4096,egress=0:3", "", nil},
+		{"vlanid=3134,egress=0:8", "", nil},
+		{"vlanid=3134,ingress=8:0", "", nil},
+		{"vlanid=3134,egress=0-3", "", nil},
+		{"vlanid=3134,priority=3", "", nil},
+		{"vlanid", "", nil},
+	} {
+		vlanID, qos, err := parseVlanQoSFlag(tt.flag)
+		if tt.qos == nil {
+			if err == nil {
+				t.Errorf("parseVlanQoSFlag(%s) succeeded, want an error", tt.flag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVlanQoSFlag(%s) failed: %s", tt.flag, err)
+			continue
+		}
+		if vlanID != tt.vlanID || !reflect.DeepEqual(qos, tt.qos) {
+			t.Errorf("parseVlanQoSFlag(%s) = %s, %+v, want %s, %+v", tt.flag, vlanID, qos, tt.vlanID, tt.qos)
+		}
+	}
+}
+
+func TestQoSChanges(t *testing.T) {
+	for _, tt := range []struct {
+		current, desired map[uint64]uint64
+		want             []string
+	}{
+		{map[uint64]uint64{}, map[uint64]uint64{}, nil},
+		{map[uint64]uint64{0: 3}, map[uint64]uint64{0: 3}, nil},
+		{map[uint64]uint64{}, map[uint64]uint64{1: 5, 0: 3}, []string{"0:3", "1:5"}},
+		{map[uint64]uint64{0: 3, 1: 5}, map[uint64]uint64{0: 4}, []string{"0:4", "1:0"}},
+	} {
+		if got := qosChanges(tt.current, tt.desired); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("qosChanges(%v, %v) = %v, want %v", tt.current, tt.desired, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeVlanID(t *testing.T) {
+	for _, tt := range []struct {
+		vlanID, want string
+	}{
+		{"3134", "3134"},
+		{"0xc3e", "3134"},
+		{"0", "0"},
+		{"", ""},
+		{"4096", "4096"},
+		{"vlan3134", "vlan3134"},
+	} {
+		if got := normalizeVlanID(tt.vlanID); got != tt.want {
+			t.Errorf("normalizeVlanID(%s) = %s, want %s", tt.vlanID, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVlanQoS(t *testing.T) {
+	setVlanQoSConfig(map[string]*VlanQoS{"3134": {EgressMap: "0:3 1:5"}})
+	defer setVlanQoSConfig(make(map[string]*VlanQoS))
+
+	// The links do not exist, so only the configured mappings can conflict
+	for _, tt := range []struct {
+		vlanID string
+		qos    *VlanQoS
+		valid  bool
+	}{
+		{"3134", &VlanQoS{EgressMap: "1:5 0:3"}, true},
+		{"3134", &VlanQoS{EgressMap: "0:3 1:5 2:0"}, true},
+		{"3134", &VlanQoS{IngressMap: "5:5"}, true},
+		{"3134", &VlanQoS{EgressMap: "0:4"}, false},
+		{"3134", &VlanQoS{EgressMap: "0:3"}, false},
+		{"3135", &VlanQoS{EgressMap: "0:4"}, true},
+	} {
+		if err := checkVlanQoS(tt.vlanID, "plumbertest0."+tt.vlanID, tt.qos); (err == nil) != tt.valid {
+			t.Errorf("checkVlanQoS(%s, %+v) returned %v, want valid %v", tt.vlanID, tt.qos, err, tt.valid)
+		}
+	}
+}
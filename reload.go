@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ConfigChange is a profile, pool, VLAN, firewall or the policy that was added, removed
+// or changed by a reload.
+type ConfigChange struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Change string `json:"change"`
+}
+
+// ReloadResult reports what a reload changed and which containers are being
+// set up again because their profile changed.
+type ReloadResult struct {
+	Changes    []ConfigChange `json:"changes"`
+	Reconciled []string       `json:"reconciled,omitempty"`
+}
+
+// Reloader reloads the configuration file given with --config.
+type Reloader struct {
+	sync.Mutex
+	path      string
+	qosFlags  []string
+	poolFlags []string
+	// reconcile is the default for reloads triggered by SIGHUP
+	reconcile bool
+	docker    *docker.Client
+}
+
+var ConfigReloader *Reloader
+
+// diffMaps compares two maps with string keys by value
+func diffMaps(kind string, old, new interface{}) []ConfigChange {
+	var changes []ConfigChange
+	o, n := reflect.ValueOf(old), reflect.ValueOf(new)
+	names := make(map[string]bool)
+	for _, k := range o.MapKeys() {
+		names[k.String()] = true
+	}
+	for _, k := range n.MapKeys() {
+		names[k.String()] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		k := reflect.ValueOf(name)
+		ov, nv := o.MapIndex(k), n.MapIndex(k)
+		switch {
+		case !ov.IsValid():
+			changes = append(changes, ConfigChange{kind, name, "added"})
+		case !nv.IsValid():
+			changes = append(changes, ConfigChange{kind, name, "removed"})
+		case !reflect.DeepEqual(ov.Interface(), nv.Interface()):
+			changes = append(changes, ConfigChange{kind, name, "changed"})
+		}
+	}
+	return changes
+}
+
+func diffConfig(old, new *PlumberConfig) []ConfigChange {
+	pools := func(cfg *PlumberConfig) map[string]Pool {
+		m := make(map[string]Pool)
+		for _, p := range cfg.Pools {
+			m[p.Name] = Pool{Name: p.Name, VlanID: p.VlanID, Subnet: p.Subnet, Gateway: p.Gateway, Range: p.Range, Exclude: p.Exclude}
+		}
+		return m
+	}
+	changes := diffMaps("profile", old.Profiles, new.Profiles)
+	changes = append(changes, diffMaps("pool", pools(old), pools(new))...)
+	changes = append(changes, diffMaps("vlan", old.Vlans, new.Vlans)...)
+	changes = append(changes, diffMaps("firewall", old.Firewalls, new.Firewalls)...)
+	if !reflect.DeepEqual(old.Policy, new.Policy) {
+		changes = append(changes, ConfigChange{"policy", "policy", "changed"})
+	}
+	return changes
+}
+
+// Reload reads and validates the configuration file and swaps it in when it
+// is valid. With reconcile, containers whose profile changed are set up again.
+func (r *Reloader) Reload(reconcile bool) (*ReloadResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		ConfigReloads.Inc("failed")
+		return nil, err
+	}
+	qos, err := initializeVlanQoS(cfg.Vlans, r.qosFlags)
+	if err != nil {
+		ConfigReloads.Inc("failed")
+		return nil, fmt.Errorf("Invalid VLAN QoS mappings: %s", err.Error())
+	}
+	pools, err := collectPools(cfg.Pools, r.poolFlags)
+	if err == nil {
+		_, err = poolMap(pools)
+	}
+	if err != nil {
+		ConfigReloads.Inc("failed")
+		return nil, fmt.Errorf("Invalid address pools: %s", err.Error())
+	}
+	var am *AddressManager
+	current := currentIPAM()
+	if current == nil && len(pools) > 0 {
+		if am, err = NewAddressManager(StateDir, pools); err != nil {
+			ConfigReloads.Inc("failed")
+			return nil, fmt.Errorf("Failed initializing address pools: %s", err.Error())
+		}
+	}
+
+	// Everything is valid, swap it in
+	old := currentConfig()
+	setConfig(cfg)
+	parentLinkLock.Lock()
+	setVlanQoSConfig(qos)
+	parentLinkLock.Unlock()
+	if am != nil {
+		setIPAM(am)
+	} else if current != nil {
+		current.SetPools(pools)
+	}
+	ConfigReloads.Inc("succeeded")
+
+	result := &ReloadResult{Changes: diffConfig(old, cfg)}
+	changed := make(map[string]bool)
+	for _, change := range result.Changes {
+		Logger.Printf("Configuration reloaded: %s '%s' %s", change.Kind, change.Name, change.Change)
+		switch change.Kind {
+		case "profile":
+			changed[change.Name] = change.Change == "changed"
+		case "vlan":
+			r.applyVlanQoS(change.Name, qos[change.Name])
+		}
+	}
+	if len(result.Changes) == 0 {
+		result.Changes = []ConfigChange{}
+		Logger.Println("Configuration reloaded without changes")
+	}
+
+	for _, cs := range State.Containers() {
+		replumb, ok := changed[cs.Network.Profile]
+		if !ok || cs.Status == StatusStopped {
+			continue
+		}
+		if !replumb {
+			Logger.Warnf("Container '%s' uses removed profile '%s', keeping its network until it restarts", cs.Name, cs.Network.Profile)
+			continue
+		}
+		if !reconcile {
+			Logger.Printf("Container '%s' uses changed profile '%s', it is updated when it restarts", cs.Name, cs.Network.Profile)
+			continue
+		}
+		result.Reconciled = append(result.Reconciled, cs.Name)
+		// Addresses of a pool the profile no longer uses are released
+		release := old.Profiles[cs.Network.Profile].IPAM != cfg.Profiles[cs.Network.Profile].IPAM &&
+			cs.Network.IPAM == old.Profiles[cs.Network.Profile].IPAM
+		go NewContainer(cs.ID).reconcileNetwork(cs, release, r.docker)
+	}
+	return result, nil
+}
+
+// applyVlanQoS updates the 802.1p mappings of the parent links on a VLAN whose
+// configuration changed. Removed mappings are left as they are.
+func (r *Reloader) applyVlanQoS(vlanID string, qos *VlanQoS) {
+	if qos == nil {
+		return
+	}
+	for _, p := range State.Parents() {
+		if p.VlanID == "" || normalizeVlanID(p.VlanID) != vlanID {
+			continue
+		}
+		if DryRun {
+			Logger.Printf("Dry run: would set QoS mappings of '%s' to egress '%s', ingress '%s'", p.Name, qos.EgressMap, qos.IngressMap)
+			continue
+		}
+		unlock := lockParentLinks()
+		changed, err := applyVlanQoS(p.Name, qos)
+		unlock()
+		if err != nil {
+			Logger.Errorf("Failed updating QoS mappings of '%s': %s", p.Name, err.Error())
+		} else if changed {
+			Logger.Printf("Set QoS mappings of '%s' to egress '%s', ingress '%s'", p.Name, qos.EgressMap, qos.IngressMap)
+		}
+	}
+}
+
+// handleSignals reloads the configuration on every SIGHUP
+func (r *Reloader) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		Logger.Printf("Reloading configuration '%s'", r.path)
+		if _, err := r.Reload(r.reconcile); err != nil {
+			Logger.Errorf("Failed reloading configuration, keeping the current one: %s", err.Error())
+		}
+	}
+}
+
+// reconcileNetwork removes the container link and sets the network up again
+// from the current configuration. Unless release is set the lease is kept, so
+// the container keeps its address.
+func (c *Container) reconcileNetwork(cs ContainerState, release bool, d *docker.Client) {
+	c.Name = cs.Name
+	if DryRun {
+		// Only log what setting up the network again would do
+		c.Logger.Printf("Dry run: would remove link '%s' of container '%s' and set up its network again for profile '%s'", cs.Network.ifName(), cs.Name, cs.Network.Profile)
+		c.handleContainerNetwork(d)
+		return
+	}
+	c.Logger.Printf("Setting up network of container '%s' again for profile '%s'", cs.Name, cs.Network.Profile)
+	c.removeMirror()
+	if cs.Status == StatusOnline {
+		if err := c.teardownContainerLink(cs.Name, &cs.Network); err != nil {
+			c.Logger.Errorf("Failed removing container link: %s", err.Error())
+			return
+		}
+	}
+	if am := currentIPAM(); release && am != nil && strings.HasPrefix(cs.Network.IPAM, "pool:") {
+		if err := am.Release(strings.TrimPrefix(cs.Network.IPAM, "pool:"), "", leaseOwner(cs.Name, &cs.Network)); err != nil {
+			c.Logger.Errorf("Failed releasing addresses: %s", err.Error())
+		}
+	}
+	c.handleContainerNetwork(d)
+}
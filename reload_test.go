@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	validated, err := parsePoolFlag("name=backoffice,vlanid=3134,subnet=10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := func() *PlumberConfig {
+		return &PlumberConfig{
+			Pools:     []*Pool{{Name: "backoffice", VlanID: "3134", Subnet: "10.0.0.0/24"}},
+			Vlans:     map[string]*VlanQoS{"3134": {EgressMap: "0:3"}},
+			Firewalls: map[string]string{"web": "in tcp 80"},
+			Profiles:  map[string]*Profile{"web": {ContainerNetworkConfig: ContainerNetworkConfig{VlanID: "3134"}}},
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(cfg *PlumberConfig)
+		want   []ConfigChange
+	}{
+		{"unchanged", func(cfg *PlumberConfig) {}, nil},
+		// Only the configured fields of pools count, not those validation computes
+		{"validated pool", func(cfg *PlumberConfig) { cfg.Pools = []*Pool{validated} }, nil},
+		{"profile changed", func(cfg *PlumberConfig) {
+			cfg.Profiles["web"] = &Profile{ContainerNetworkConfig: ContainerNetworkConfig{VlanID: "3135"}}
+		}, []ConfigChange{{"profile", "web", "changed"}}},
+		{"profile added and removed", func(cfg *PlumberConfig) {
+			cfg.Profiles = map[string]*Profile{"db": {}}
+		}, []ConfigChange{{"profile", "db", "added"}, {"profile", "web", "removed"}}},
+		{"pool changed", func(cfg *PlumberConfig) {
+			cfg.Pools[0].Exclude = []string{"10.0.0.10"}
+		}, []ConfigChange{{"pool", "backoffice", "changed"}}},
+		{"vlan and firewall", func(cfg *PlumberConfig) {
+			cfg.Vlans["3134"] = &VlanQoS{EgressMap: "0:4"}
+			delete(cfg.Firewalls, "web")
+		}, []ConfigChange{{"vlan", "3134", "changed"}, {"firewall", "web", "removed"}}},
+		{"policy", func(cfg *PlumberConfig) {
+			cfg.Policy = &Policy{Default: PolicyDeny}
+		}, []ConfigChange{{"policy", "policy", "changed"}}},
+	} {
+		cfg := base()
+		tt.change(cfg)
+		if got := diffConfig(base(), cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffConfig = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ratePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)([kmgt]?)(bit|bps)$`)
+	sizePattern = regexp.MustCompile(`^\d+([kmg]?b?|[kmg]bit)$`)
+	rateUnits   = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12}
+)
+
+// parseRate parses a tc rate such as '100mbit' or '10mbps' into bits per second
+func parseRate(s string) (uint64, error) {
+	m := ratePattern.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("Invalid rate '%s'", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid rate '%s'", s)
+	}
+	bits := n * rateUnits[m[2]]
+	if m[3] == "bps" {
+		bits *= 8
+	}
+	if bits < 8 {
+		return 0, fmt.Errorf("Rate '%s' is too low", s)
+	}
+	return uint64(bits), nil
+}
+
+// burstFor returns burst, or a default that holds 10ms of traffic at rate
+func burstFor(rate uint64, burst string) string {
+	if burst != "" {
+		return burst
+	}
+	size := rate / 8 / 100
+	if size < 16*1024 {
+		size = 16 * 1024
+	}
+	return fmt.Sprintf("%db", size)
+}
+
+func validateShaping(cn *ContainerNetworkConfig) error {
+	for _, l := range []struct{ rate, burst, dir string }{
+		{cn.EgressRate, cn.EgressBurst, "egress"},
+		{cn.IngressRate, cn.IngressBurst, "ingress"},
+	} {
+		if l.rate == "" {
+			if l.burst != "" {
+				return fmt.Errorf("The %s burst requires an %s rate", l.dir, l.dir)
+			}
+			continue
+		}
+		if _, err := parseRate(l.rate); err != nil {
+			return err
+		}
+		if l.burst != "" && !sizePattern.MatchString(strings.ToLower(l.burst)) {
+			return fmt.Errorf("Invalid %s burst '%s'", l.dir, l.burst)
+		}
+	}
+	return nil
+}
+
+// tc runs the tc command. The calling thread must be in the network namespace
+// of the device, which the tc process inherits. Tests replace it to record the
+// commands.
+var tc = func(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("tc", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error running 'tc %s': %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// applyShaping limits traffic sent by the container with a token bucket and
+// traffic it receives with a policer on the clsact ingress hook of dev. Network
+// impairment is the root qdisc with the token bucket as its child. Qdiscs of
+// previous, the shaping applied before if any, that are no longer configured
+// are removed, so it can be applied again. Qdiscs plumber did not configure
+// are left alone.
+func applyShaping(dev string, cn *ContainerNetworkConfig, previous *ContainerNetworkConfig) error {
+	if previous == nil {
+		previous = &ContainerNetworkConfig{}
+	}
+	// Replacing a root qdisc of another kind fails, so start from the default
+	if cn.Netem != nil || cn.EgressRate != "" || previous.Netem != nil || previous.EgressRate != "" {
+		tc("qdisc", "del", "dev", dev, "root")
+	}
+	parent := []string{"root", "handle", "1:"}
+	if cn.Netem != nil {
+		args := append([]string{"qdisc", "add", "dev", dev}, parent...)
+		if err := tc(append(args, cn.Netem.args()...)...); err != nil {
+			return err
+		}
+		parent = []string{"parent", "1:1", "handle", "10:"}
+	}
+	if cn.EgressRate != "" {
+		rate, err := parseRate(cn.EgressRate)
+		if err != nil {
+			return err
+		}
+		args := append([]string{"qdisc", "add", "dev", dev}, parent...)
+		if err := tc(append(args, "tbf", "rate", cn.EgressRate, "burst", burstFor(rate, cn.EgressBurst), "latency", "50ms")...); err != nil {
+			return err
+		}
+	}
+
+	// The policer shares the clsact qdisc with mirroring, so only its filter is replaced
+	if cn.IngressRate != "" || previous.IngressRate != "" {
+		tc("filter", "del", "dev", dev, "ingress", "prio", "1")
+	}
+	if cn.IngressRate != "" {
+		rate, err := parseRate(cn.IngressRate)
+		if err != nil {
+			return err
+		}
+		// The clsact qdisc may already be there for mirroring
+		tc("qdisc", "add", "dev", dev, "clsact")
+		if err := tc("filter", "add", "dev", dev, "ingress", "protocol", "all", "prio", "1",
+			"u32", "match", "u32", "0", "0",
+			"police", "rate", cn.IngressRate, "burst", burstFor(rate, cn.IngressBurst), "drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordTC replaces tc with a recorder of the commands it is given, and
+// returns the commands and a function restoring tc
+func recordTC() (*[]string, func()) {
+	var commands []string
+	run := tc
+	tc = func(args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return nil
+	}
+	return &commands, func() { tc = run }
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tt := range []struct {
+		rate string
+		bits uint64
+	}{
+		{"100mbit", 100e6},
+		{"100Mbit", 100e6},
+		{"10mbps", 80e6},
+		{"1.5gbit", 1.5e9},
+		{"64kbit", 64e3},
+		{"1tbit", 1e12},
+		{"8bit", 8},
+		{"1bps", 8},
+		{"7bit", 0},
+		{"100", 0},
+		{"100mb", 0},
+		{"mbit", 0},
+		{"-1mbit", 0},
+		{"1.mbit", 0},
+		{"", 0},
+	} {
+		bits, err := parseRate(tt.rate)
+		switch {
+		case tt.bits == 0 && err == nil:
+			t.Errorf("parseRate(%s) = %d, want an error", tt.rate, bits)
+		case tt.bits != 0 && err != nil:
+			t.Errorf("parseRate(%s) failed: %s", tt.rate, err)
+		case bits != tt.bits:
+			t.Errorf("parseRate(%s) = %d, want %d", tt.rate, bits, tt.bits)
+		}
+	}
+}
+
+func TestBurstFor(t *testing.T) {
+	for _, tt := range []struct {
+		rate  uint64
+		burst string
+		want  string
+	}{
+		{1e9, "", "1250000b"},
+		{1e6, "", "16384b"},
+		{1e9, "64kb", "64kb"},
+	} {
+		if got := burstFor(tt.rate, tt.burst); got != tt.want {
+			t.Errorf("burstFor(%d, %s) = %s, want %s", tt.rate, tt.burst, got, tt.want)
+		}
+	}
+}
+
+func TestValidateShaping(t *testing.T) {
+	for _, tt := range []struct {
+		cn    ContainerNetworkConfig
+		valid bool
+	}{
+		{ContainerNetworkConfig{}, true},
+		{ContainerNetworkConfig{EgressRate: "100mbit", EgressBurst: "32kb"}, true},
+		{ContainerNetworkConfig{IngressRate: "10mbps", IngressBurst: "1mbit"}, true},
+		{ContainerNetworkConfig{EgressRate: "100mbit", IngressRate: "10mbit", IngressBurst: "15000"}, true},
+		{ContainerNetworkConfig{EgressBurst: "32kb"}, false},
+		{ContainerNetworkConfig{IngressBurst: "32kb"}, false},
+		{ContainerNetworkConfig{EgressRate: "fast"}, false},
+		{ContainerNetworkConfig{IngressRate: "10mbit", IngressBurst: "32 kb"}, false},
+		{ContainerNetworkConfig{EgressRate: "10mbit", EgressBurst: "32kbps"}, false},
+	} {
+		if err := validateShaping(&tt.cn); (err == nil) != tt.valid {
+			t.Errorf("validateShaping(%+v) returned %v, want valid %v", tt.cn, err, tt.valid)
+		}
+	}
+}
+
+func TestApplyShaping(t *testing.T) {
+	for _, tt := range []struct {
+		cn, previous *ContainerNetworkConfig
+		commands     []string
+	}{
+		{&ContainerNetworkConfig{}, nil, nil},
+		{&ContainerNetworkConfig{EgressRate: "100mbit"}, nil, []string{
+			"qdisc del dev eth1 root",
+			"qdisc add dev eth1 root handle 1: tbf rate 100mbit burst 125000b latency 50ms",
+		}},
+		{&ContainerNetworkConfig{IngressRate: "10mbit", IngressBurst: "32kb"}, nil, []string{
+			"filter del dev eth1 ingress prio 1",
+			"qdisc add dev eth1 clsact",
+			"filter add dev eth1 ingress protocol all prio 1 u32 match u32 0 0 police rate 10mbit burst 32kb drop flowid :1",
+		}},
+		// The token bucket goes below network impairment
+		{&ContainerNetworkConfig{EgressRate: "100mbit", EgressBurst: "64kb", Netem: &Netem{Delay: "100ms"}}, nil, []string{
+			"qdisc del dev eth1 root",
+			"qdisc add dev eth1 root handle 1: netem delay 100000us",
+			"qdisc add dev eth1 parent 1:1 handle 10: tbf rate 100mbit burst 64kb latency 50ms",
+		}},
+		// Shaping that is no longer configured is removed
+		{&ContainerNetworkConfig{}, &ContainerNetworkConfig{EgressRate: "100mbit", IngressRate: "10mbit"}, []string{
+			"qdisc del dev eth1 root",
+			"filter del dev eth1 ingress prio 1",
+		}},
+	} {
+		commands, restore := recordTC()
+		err := applyShaping("eth1", tt.cn, tt.previous)
+		restore()
+		if err != nil {
+			t.Errorf("applyShaping(%+v) failed: %s", tt.cn, err)
+			continue
+		}
+		if !reflect.DeepEqual(*commands, tt.commands) {
+			t.Errorf("applyShaping(%+v, %+v) ran\n%q\nwant\n%q", tt.cn, tt.previous, *commands, tt.commands)
+		}
+	}
+}
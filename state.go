@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending = "pending"
+	StatusOnline  = "online"
+	StatusFailed  = "failed"
+	StatusStopped = "stopped"
+)
+
+// ContainerState is what plumber knows about a container it has plumbed.
+type ContainerState struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Network    ContainerNetworkConfig `json:"network"`
+	MacAddr    string                 `json:"macAddress,omitempty"`
+	IPAddr     string                 `json:"ipAddress,omitempty"`
+	ParentLink string                 `json:"parentLink,omitempty"`
+	Netns      string                 `json:"netns,omitempty"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	// NetworkStatus is the outcome of the connectivity probe after setup
+	NetworkStatus       string    `json:"networkStatus,omitempty"`
+	NetworkStatusDetail string    `json:"networkStatusDetail,omitempty"`
+	UpdatedAt           time.Time `json:"updatedAt"`
+}
+
+// ParentState describes a host link that container links are attached to.
+type ParentState struct {
+	Name       string   `json:"name"`
+	VlanID     string   `json:"vlanId,omitempty"`
+	RefCount   int      `json:"refCount"`
+	Containers []string `json:"containers"`
+}
+
+type Store struct {
+	sync.RWMutex
+	containers map[string]*ContainerState
+}
+
+var State = NewStore()
+
+func NewStore() *Store {
+	return &Store{
+		containers: make(map[string]*ContainerState),
+	}
+}
+
+// Update applies fn to the state of container id, creating it when needed.
+func (s *Store) Update(id string, fn func(cs *ContainerState)) {
+	s.Lock()
+	defer s.Unlock()
+	cs, ok := s.containers[id]
+	if !ok {
+		cs = &ContainerState{ID: id}
+		s.containers[id] = cs
+	}
+	fn(cs)
+	cs.UpdatedAt = time.Now()
+}
+
+// SetStatus changes the status of a known container; unknown containers are ignored.
+func (s *Store) SetStatus(id string, status string) {
+	s.Lock()
+	defer s.Unlock()
+	if cs, ok := s.containers[id]; ok {
+		cs.Status = status
+		cs.UpdatedAt = time.Now()
+	}
+}
+
+func (s *Store) Remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.containers, id)
+}
+
+func (s *Store) Containers() []ContainerState {
+	s.RLock()
+	defer s.RUnlock()
+	list := make([]ContainerState, 0, len(s.containers))
+	for _, cs := range s.containers {
+		list = append(list, *cs)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ambiguousRefError is returned for an ID prefix of more than one container
+type ambiguousRefError struct {
+	ref     string
+	matches int
+}
+
+func (e *ambiguousRefError) Error() string {
+	return fmt.Sprintf("Ambiguous reference '%s' matches %d containers", e.ref, e.matches)
+}
+
+// Container looks up a container by ID, unique ID prefix or name.
+func (s *Store) Container(ref string) (ContainerState, bool) {
+	cs, err := s.Lookup(ref)
+	return cs, err == nil
+}
+
+// Lookup finds a container by ID, unique ID prefix or name, and tells a
+// missing container from an ambiguous prefix.
+func (s *Store) Lookup(ref string) (ContainerState, error) {
+	s.RLock()
+	defer s.RUnlock()
+	// Names win over IDs, as a name may start with the ID of another container
+	name := "/" + strings.TrimPrefix(ref, "/")
+	for _, cs := range s.containers {
+		if cs.Name == name {
+			return *cs, nil
+		}
+	}
+	var matches []*ContainerState
+	for _, cs := range s.containers {
+		// IDs match exactly, also the full ID of which plumber keeps 12 characters
+		if strings.HasPrefix(ref, cs.ID) {
+			return *cs, nil
+		}
+		if strings.HasPrefix(cs.ID, ref) {
+			matches = append(matches, cs)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return ContainerState{}, fmt.Errorf("No such container: %s", ref)
+	case 1:
+		return *matches[0], nil
+	default:
+		return ContainerState{}, &ambiguousRefError{ref, len(matches)}
+	}
+}
+
+// Parents lists the parent links in use, counting the pending and online
+// containers that reference them.
+func (s *Store) Parents() []ParentState {
+	s.RLock()
+	defer s.RUnlock()
+	parents := make(map[string]*ParentState)
+	for _, cs := range s.containers {
+		if cs.ParentLink == "" {
+			continue
+		}
+		p, ok := parents[cs.ParentLink]
+		if !ok {
+			p = &ParentState{Name: cs.ParentLink, VlanID: cs.Network.VlanID, Containers: []string{}}
+			parents[cs.ParentLink] = p
+		}
+		if cs.Status == StatusOnline || cs.Status == StatusPending {
+			p.RefCount++
+			p.Containers = append(p.Containers, cs.Name)
+		}
+	}
+	list := make([]ParentState, 0, len(parents))
+	for _, p := range parents {
+		sort.Strings(p.Containers)
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
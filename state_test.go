@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestStoreLookup(t *testing.T) {
+	s := NewStore()
+	for id, name := range map[string]string{
+		"3f4a1c2b9d8e": "/web",
+		"3f4a77e01234": "/db",
+		"9b1c00d4e5f6": "/cache",
+		// A name starting with the ID of another container
+		"c0ffee000001": "/3f4a1c2b9d8e-old",
+		"c0ffee000002": "/9b1c00d4e5f6",
+	} {
+		name := name
+		s.Update(id, func(cs *ContainerState) { cs.Name = name })
+	}
+
+	for _, tt := range []struct {
+		ref       string
+		want      string
+		ambiguous bool
+	}{
+		{"web", "3f4a1c2b9d8e", false},
+		{"/db", "3f4a77e01234", false},
+		{"3f4a1", "3f4a1c2b9d8e", false},
+		{"9b", "9b1c00d4e5f6", false},
+		{"3f4a1c2b9d8e", "3f4a1c2b9d8e", false},
+		{"3f4a1c2b9d8e0123456789abcdef0123456789abcdef0123456789abcdef0123", "3f4a1c2b9d8e", false},
+		{"3f4a", "", true},
+		{"3f", "", true},
+		{"3f4a1c2b9d8e-old", "c0ffee000001", false},
+		{"9b1c00d4e5f6", "c0ffee000002", false},
+		{"/9b1c00d4e5f6", "c0ffee000002", false},
+		{"c0ffee", "", true},
+		{"ffff", "", false},
+		{"/api", "", false},
+	} {
+		cs, err := s.Lookup(tt.ref)
+		_, ambiguous := err.(*ambiguousRefError)
+		switch {
+		case tt.want != "" && (err != nil || cs.ID != tt.want):
+			t.Errorf("Lookup(%s) = %s, %v, want %s", tt.ref, cs.ID, err, tt.want)
+		case tt.want == "" && (err == nil || ambiguous != tt.ambiguous):
+			t.Errorf("Lookup(%s) returned %v, want an error that is ambiguous %v", tt.ref, err, tt.ambiguous)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/urfave/cli"
+)
+
+// syncResult is the outcome of setting up the network of an existing container
+type syncResult struct {
+	ID     string
+	Name   string
+	Status string
+	Detail string
+}
+
+func syncCommand() cli.Command {
+	return cli.Command{
+		Name:  "sync",
+		Usage: "Set up the network of the running containers once and report the outcome",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "name",
+				Usage: "Only containers whose name matches, as in 'docker ps --filter name='",
+			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "Only containers with this label, 'key' or 'key=value'",
+			},
+		},
+		Action: runSync,
+	}
+}
+
+func runSync(ctx *cli.Context) error {
+	if err := initializeGlobals(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	d, err := initializeDocker(DockerHost)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed initializing docker client: %s", err.Error()), 1)
+	}
+	filters := map[string][]string{"status": {"running"}}
+	if names := ctx.StringSlice("name"); len(names) > 0 {
+		filters["name"] = names
+	}
+	if labels := ctx.StringSlice("label"); len(labels) > 0 {
+		filters["label"] = labels
+	}
+	results, err := syncContainers(d, docker.ListContainersOptions{Filters: filters})
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to get containers: %s", err.Error()), 1)
+	}
+
+	if failed := writeSyncResults(os.Stdout, results); failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d container(s) failed", failed, len(results)), 1)
+	}
+	return nil
+}
+
+// writeSyncResults writes the results as a table and returns how many failed
+func writeSyncResults(out io.Writer, results []syncResult) int {
+	failed := 0
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tID\tSTATUS\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, r.ID, r.Status, r.Detail)
+		if r.Status == StatusFailed {
+			failed++
+		}
+	}
+	w.Flush()
+	return failed
+}
+
+// syncContainers sets up the network of the running containers docker lists
+// for opts and waits until all setups finished.
+func syncContainers(d *docker.Client, opts docker.ListContainersOptions) ([]syncResult, error) {
+	containers, err := d.ListContainers(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		results []syncResult
+	)
+	for _, container := range containers {
+		if container.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(container docker.APIContainers) {
+			defer wg.Done()
+			c := NewContainer(container.ID[0:12])
+			r := c.syncResult(c.handleContainerNetwork(d))
+			if r.Name == "" && len(container.Names) > 0 {
+				r.Name = container.Names[0]
+			}
+			lock.Lock()
+			results = append(results, r)
+			lock.Unlock()
+		}(container)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results, nil
+}
+
+// syncResult describes the state handleContainerNetwork left the container and
+// its attachments in. A failed attachment fails the container.
+func (c *Container) syncResult(err error) syncResult {
+	r := syncResult{ID: c.ID, Name: c.Name}
+	cs, ok := State.Container(c.ID)
+	switch {
+	case err != nil:
+		r.Status, r.Detail = StatusFailed, err.Error()
+	case DryRun:
+		r.Status, r.Detail = "planned", "dry run"
+	case !ok:
+		r.Status, r.Detail = "skipped", "no plumber network"
+	default:
+		r.Status = cs.Status
+		r.Detail = fmt.Sprintf("%s on %s", cs.MacAddr, cs.ParentLink)
+		if cs.IPAddr != "" {
+			r.Detail = fmt.Sprintf("%s %s on %s", cs.IPAddr, cs.MacAddr, cs.ParentLink)
+		}
+	}
+	if DryRun || Attachments == nil || c.Name == "" {
+		return r
+	}
+	attachments, err := Attachments.List(c.Name)
+	if err != nil {
+		r.Status = StatusFailed
+		r.Detail = strings.TrimPrefix(r.Detail+"; attachments: "+err.Error(), "; ")
+		return r
+	}
+	for _, a := range attachments {
+		detail := fmt.Sprintf("%s: %s %s on %s", a.Network.IfName, a.IPAddr, a.MacAddr, a.ParentLink)
+		if a.IPAddr == "" {
+			detail = fmt.Sprintf("%s: %s on %s", a.Network.IfName, a.MacAddr, a.ParentLink)
+		}
+		switch {
+		case a.Status == StatusFailed:
+			r.Status = StatusFailed
+			detail = fmt.Sprintf("%s: %s", a.Network.IfName, a.Error)
+		case r.Status == "skipped":
+			r.Status, r.Detail = a.Status, ""
+		}
+		r.Detail = strings.TrimPrefix(r.Detail+"; "+detail, "; ")
+	}
+	return r
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestSyncResult(t *testing.T) {
+	Logger = logrus.New()
+	Logger.Out = ioutil.Discard
+	defer func(store *Store) { State = store }(State)
+	State = NewStore()
+	defer func(store *AttachmentStore) { Attachments = store }(Attachments)
+	dir, err := ioutil.TempDir("", "plumber-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Attachments = NewAttachmentStore(dir)
+
+	State.Update("3f4a1c2b9d8e", func(cs *ContainerState) {
+		cs.Name, cs.Status = "/web", StatusOnline
+		cs.IPAddr, cs.MacAddr, cs.ParentLink = "10.0.0.5/24", "02:42:ac:11:00:02", "eth0.3134"
+	})
+	State.Update("9b1c00d4e5f6", func(cs *ContainerState) {
+		cs.Name, cs.Status = "/db", StatusOnline
+		cs.MacAddr, cs.ParentLink = "02:42:ac:11:00:03", "eth0"
+	})
+	for _, a := range []Attachment{
+		{Container: "web", Network: ContainerNetworkConfig{IfName: "eth1"}, Status: StatusOnline, IPAddr: "10.0.1.5/24", MacAddr: "02:42:ac:11:00:04", ParentLink: "eth0.100"},
+		{Container: "db", Network: ContainerNetworkConfig{IfName: "eth1"}, Status: StatusFailed, Error: "Pool 'backoffice' is exhausted"},
+		{Container: "cache", Network: ContainerNetworkConfig{IfName: "eth1"}, Status: StatusOnline, MacAddr: "02:42:ac:11:00:05", ParentLink: "eth0"},
+	} {
+		if err := Attachments.Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		id, name string
+		err      error
+		want     syncResult
+	}{
+		{"3f4a1c2b9d8e", "/web", nil, syncResult{"3f4a1c2b9d8e", "/web", StatusOnline,
+			"10.0.0.5/24 02:42:ac:11:00:02 on eth0.3134; eth1: 10.0.1.5/24 02:42:ac:11:00:04 on eth0.100"}},
+		// A failed attachment fails the container
+		{"9b1c00d4e5f6", "/db", nil, syncResult{"9b1c00d4e5f6", "/db", StatusFailed,
+			"02:42:ac:11:00:03 on eth0; eth1: Pool 'backoffice' is exhausted"}},
+		// A container with only attachments takes their status
+		{"c0ffee000001", "/cache", nil, syncResult{"c0ffee000001", "/cache", StatusOnline,
+			"eth1: 02:42:ac:11:00:05 on eth0"}},
+		{"c0ffee000002", "/queue", nil, syncResult{"c0ffee000002", "/queue", "skipped", "no plumber network"}},
+		{"c0ffee000003", "/queue", errors.New("Error inspecting container"), syncResult{"c0ffee000003", "/queue", StatusFailed,
+			"Error inspecting container"}},
+	} {
+		c := NewContainer(tt.id)
+		c.Name = tt.name
+		if r := c.syncResult(tt.err); !reflect.DeepEqual(r, tt.want) {
+			t.Errorf("syncResult(%s, %v) = %+v, want %+v", tt.name, tt.err, r, tt.want)
+		}
+	}
+
+	defer func(dryRun bool) { DryRun = dryRun }(DryRun)
+	DryRun = true
+	c := NewContainer("9b1c00d4e5f6")
+	c.Name = "/db"
+	if r := c.syncResult(nil); r.Status != "planned" {
+		t.Errorf("syncResult in a dry run = %+v, want planned", r)
+	}
+}
+
+func TestWriteSyncResults(t *testing.T) {
+	var b bytes.Buffer
+	failed := writeSyncResults(&b, []syncResult{
+		{"9b1c00d4e5f6", "/db", StatusFailed, "eth1: Pool 'backoffice' is exhausted"},
+		{"c0ffee000002", "/queue", "skipped", "no plumber network"},
+		{"3f4a1c2b9d8e", "/web", StatusOnline, "10.0.0.5/24 02:42:ac:11:00:02 on eth0.3134"},
+	})
+	if failed != 1 {
+		t.Errorf("writeSyncResults counted %d failed, want 1", failed)
+	}
+	want := strings.Join([]string{
+		"CONTAINER  ID            STATUS   DETAIL",
+		"/db        9b1c00d4e5f6  failed   eth1: Pool 'backoffice' is exhausted",
+		"/queue     c0ffee000002  skipped  no plumber network",
+		"/web       3f4a1c2b9d8e  online   10.0.0.5/24 02:42:ac:11:00:02 on eth0.3134",
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Errorf("writeSyncResults wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
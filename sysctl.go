@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Only sysctls below these prefixes are namespaced per network namespace
+var allowedSysctls = []string{
+	"net.ipv4.conf.",
+	"net.ipv4.neigh.",
+	"net.ipv4.route.",
+	"net.ipv4.tcp_",
+	"net.ipv4.icmp_",
+	"net.ipv4.ip_forward",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.ipv6.conf.",
+	"net.ipv6.neigh.",
+	"net.ipv6.route.",
+	"net.ipv6.icmp.",
+	"net.core.somaxconn",
+}
+
+// Sysctls below these prefixes are per interface, e.g.
+// net.ipv4.conf.eth0.3134.rp_filter for the VLAN link eth0.3134
+var interfaceSysctls = []string{
+	"net.ipv4.conf.",
+	"net.ipv4.neigh.",
+	"net.ipv6.conf.",
+	"net.ipv6.neigh.",
+}
+
+var sysctlKeyPattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// sysctlPath returns the /proc/sys file of a sysctl. Interface names may hold
+// dots but parameter names do not, so only the prefix and the last dot of a
+// per interface sysctl separate path elements.
+func sysctlPath(key string) (string, error) {
+	for _, prefix := range interfaceSysctls {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		i := strings.LastIndex(rest, ".")
+		if i <= 0 || i == len(rest)-1 {
+			return "", fmt.Errorf("Sysctl '%s' requires an interface and a parameter", key)
+		}
+		return filepath.Join("/proc/sys", strings.Replace(prefix, ".", "/", -1), rest[:i], rest[i+1:]), nil
+	}
+	return filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1)), nil
+}
+
+func validateSysctls(sysctls map[string]string) error {
+	for key, value := range sysctls {
+		if !sysctlKeyPattern.MatchString(key) || strings.Contains(key, "..") {
+			return fmt.Errorf("Invalid sysctl '%s'", key)
+		}
+		allowed := false
+		for _, prefix := range allowedSysctls {
+			if strings.HasPrefix(key, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Sysctl '%s' is not a network namespace sysctl", key)
+		}
+		if _, err := sysctlPath(key); err != nil {
+			return err
+		}
+		if strings.ContainsAny(value, "\n/") {
+			return fmt.Errorf("Invalid value '%s' for sysctl '%s'", value, key)
+		}
+	}
+	return nil
+}
+
+// applySysctls writes the sysctls in sorted order. The calling thread must be
+// in the container network namespace, which /proc/sys/net reflects.
+func applySysctls(sysctls map[string]string) error {
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path, err := sysctlPath(key)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(sysctls[key]), 0644); err != nil {
+			return fmt.Errorf("Error setting sysctl '%s' to '%s': %s", key, sysctls[key], err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSysctlPath(t *testing.T) {
+	for _, tt := range []struct {
+		key, path string
+	}{
+		{"net.ipv4.ip_forward", "/proc/sys/net/ipv4/ip_forward"},
+		{"net.ipv4.tcp_syncookies", "/proc/sys/net/ipv4/tcp_syncookies"},
+		{"net.ipv4.conf.eth0.rp_filter", "/proc/sys/net/ipv4/conf/eth0/rp_filter"},
+		{"net.ipv4.conf.eth0.3134.rp_filter", "/proc/sys/net/ipv4/conf/eth0.3134/rp_filter"},
+		{"net.ipv6.conf.all.disable_ipv6", "/proc/sys/net/ipv6/conf/all/disable_ipv6"},
+		{"net.ipv6.neigh.eth1.100.base_reachable_time_ms", "/proc/sys/net/ipv6/neigh/eth1.100/base_reachable_time_ms"},
+		{"net.ipv4.conf.eth0", ""},
+		{"net.ipv4.conf.eth0.", ""},
+		{"net.ipv4.conf..rp_filter", ""},
+	} {
+		path, err := sysctlPath(tt.key)
+		switch {
+		case tt.path == "" && err == nil:
+			t.Errorf("sysctlPath(%s) = %s, want an error", tt.key, path)
+		case tt.path != "" && err != nil:
+			t.Errorf("sysctlPath(%s) failed: %s", tt.key, err)
+		case path != tt.path:
+			t.Errorf("sysctlPath(%s) = %s, want %s", tt.key, path, tt.path)
+		}
+	}
+}
+
+func TestValidateSysctls(t *testing.T) {
+	for _, tt := range []struct {
+		key, value string
+		valid      bool
+	}{
+		{"net.ipv4.ip_forward", "1", true},
+		{"net.ipv4.ip_local_port_range", "1024 65000", true},
+		{"net.ipv4.conf.eth0.3134.rp_filter", "2", true},
+		{"net.ipv6.conf.eth0.accept_ra", "0", true},
+		{"net.core.somaxconn", "1024", true},
+		{"net.core.rmem_max", "1048576", false},
+		{"kernel.shmmax", "1", false},
+		{"vm.swappiness", "10", false},
+		{"net.ipv4.conf.eth0", "1", false},
+		{"net.ipv4.conf.....rp_filter", "1", false},
+		{"net.ipv4.conf.eth0/../../rp_filter", "1", false},
+		{"net.ipv4.conf.ETH0.rp_filter", "1", false},
+		{"net.ipv4.ip_forward", "1\n", false},
+		{"net.ipv4.ip_forward", "../1", false},
+	} {
+		if err := validateSysctls(map[string]string{tt.key: tt.value}); (err == nil) != tt.valid {
+			t.Errorf("validateSysctls(%s=%q) returned %v, want valid %v", tt.key, tt.value, err, tt.valid)
+		}
+	}
+}